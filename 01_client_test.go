@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"testing"
@@ -10,7 +11,13 @@ import (
 )
 
 func T_FakeLibrary() *FCPLibrary {
-	return &FCPLibrary{"Test Project", "/path/to/test.fcpbundle", "1234", map[string]string{}, 0}
+	return &FCPLibrary{
+		Name: "Test Project",
+		Path: "/path/to/test.fcpbundle",
+		UUID: "1234",
+		Info: map[string]string{},
+		Last: 0,
+	}
 }
 
 func T_FakeClient() Client {
@@ -40,6 +47,18 @@ func Test_isSame(t *testing.T) {
 	if c.isSame(newLibs) {
 		t.Fatal()
 	}
+
+	// A rescan that found the same usage
+	c.Library["1234"].Storage = &BundleStorage{Total: 100, Scanned: 1}
+	newLibs = FCPLibraries{"1234": T_FakeLibrary()}
+	newLibs["1234"].Storage = &BundleStorage{Total: 100, Scanned: 2}
+	if !c.isSame(newLibs) {
+		t.Fatal()
+	}
+	newLibs["1234"].Storage.Total = 200
+	if c.isSame(newLibs) {
+		t.Fatal()
+	}
 }
 
 func Test_Client_Can_Be_Marshaled(t *testing.T) {
@@ -157,3 +176,34 @@ func Test_Client_Update(t *testing.T) {
 	}
 
 }
+
+func Test_Client_Status(t *testing.T) {
+
+	c := T_FakeClient()
+	c.WatchPaths = []string{"/Volumes"}
+	c.AWOL["other"] = time.Now()
+	c.ResponseTimes["other"] = 12.5
+	c.State.SetMembers(&c.Host)
+
+	res := NewCheckout()
+	res.Checkouts = append(res.Checkouts, "1234")
+	b, _ := json.Marshal(res)
+	c.HandleCheckoutResponse("other", b)
+
+	lastScan.Set(time.Now(), c.Library, []error{errors.New("lsof failed")})
+
+	status := c.Status()
+	if m := status.Members["other"]; !m.AWOL || m.RTT != 12.5 || m.URL != "http://127.0.0.1:1234" {
+		t.Fatal(status.Members)
+	}
+	if r := status.Responses["other"]; len(r.Response.Checkouts) != 1 || r.T == 0 {
+		t.Fatal(status.Responses)
+	}
+	if _, hasKey := status.Scan.Libraries["1234"]; !hasKey || len(status.Scan.Errors) != 1 {
+		t.Fatal(status.Scan)
+	}
+	if len(status.Watched) != 1 {
+		t.Fatal(status.Watched)
+	}
+
+}
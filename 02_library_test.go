@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -117,3 +123,180 @@ func Test_Library_Update(t *testing.T) {
 		t.Fatalf("Update failed check: %d | %d", t1, last)
 	}
 }
+
+func Test_Library_Save_Load(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fcpxmonitor")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, LIBRARY_STORE)
+
+	library := NewLibrary()
+	err = library.CheckoutProject("1234", "Test Project", "host1", testFCPXBundlePath, map[string]string{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t1 := time.Now().Unix()
+	library.Update(ProjectUpdate{Hostname: "host1", UUID: "1234", Last: t1})
+	err = library.Save(fp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	restored := NewLibrary()
+	err = restored.Load(fp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	chk := restored.Projects["1234"].Checkouts["host1"]
+	if chk.Last != t1 || !chk.Unconfirmed {
+		t.Fatalf("Bad restore: %+v", chk)
+	}
+
+	// Reporting in again confirms the checkout
+	restored.CheckoutProject("1234", "Test Project", "host1", testFCPXBundlePath, map[string]string{})
+	if restored.Projects["1234"].Checkouts["host1"].Unconfirmed {
+		t.Fatal("Expected checkout to be confirmed")
+	}
+}
+
+func Test_History_Query(t *testing.T) {
+	history := NewHistory("")
+	history.Append(HistoryEvent{T: 100, Kind: EVENT_CHECKOUT, UUID: "1234", Hostname: "host1"})
+	history.Append(HistoryEvent{T: 200, Kind: EVENT_CHECKOUT, UUID: "1234", Hostname: "host2"})
+	history.Append(HistoryEvent{T: 300, Kind: EVENT_CLOSE, UUID: "1234", Hostname: "host1"})
+	history.Append(HistoryEvent{T: 400, Kind: EVENT_CHECKOUT, UUID: "5678", Hostname: "host1"})
+
+	if n := len(history.Query(HistoryFilter{UUID: "1234"})); n != 3 {
+		t.Fatalf("Expected 3 events for uuid: %d", n)
+	}
+	if n := len(history.Query(HistoryFilter{Hostname: "host1", Since: 200})); n != 2 {
+		t.Fatalf("Expected 2 events for host1 since 200: %d", n)
+	}
+	if n := len(history.Query(HistoryFilter{Since: 150, Until: 350})); n != 2 {
+		t.Fatalf("Expected 2 events between 150 and 350: %d", n)
+	}
+}
+
+func Test_Library_Expire_Leases(t *testing.T) {
+	library := NewLibrary()
+	library.LeaseTTL = time.Minute
+	library.CheckoutProject("1234", "Test Project", "host1", testFCPXBundlePath, map[string]string{})
+	library.CheckoutProject("1234", "Test Project", "host2", testFCPXBundlePath, map[string]string{})
+
+	expired, _ := library.ExpireLeases(time.Now().Unix())
+	if len(expired) != 0 {
+		t.Fatal("Nothing should have expired yet")
+	}
+
+	// host2 stops reporting
+	library.Projects["1234"].Checkouts["host2"].Expires = time.Now().Add(-time.Second).Unix()
+	expired, removed := library.ExpireLeases(time.Now().Unix())
+	if len(expired) != 1 || expired[0].Hostname != "host2" || len(removed) != 0 {
+		t.Fatalf("Expected host2 to expire: %v %v", expired, removed)
+	}
+
+	// host1 renews its lease through an update
+	before := library.Projects["1234"].Checkouts["host1"].Expires
+	library.LeaseTTL = time.Hour
+	library.Update(ProjectUpdate{Hostname: "host1", UUID: "1234", Last: time.Now().Unix()})
+	if library.Projects["1234"].Checkouts["host1"].Expires <= before {
+		t.Fatal("Expected lease to be renewed")
+	}
+
+	// The project goes with its last checkout
+	library.Projects["1234"].Checkouts["host1"].Expires = time.Now().Add(-time.Second).Unix()
+	_, removed = library.ExpireLeases(time.Now().Unix())
+	if len(removed) != 1 || removed[0].UUID != "1234" || removed[0].Name != "Test Project" || removed[0].Hostname != "host1" {
+		t.Fatalf("Expected the project to be removed: %v", removed)
+	}
+}
+
+func Test_Library_Update_Event_Activity(t *testing.T) {
+	library := NewLibrary()
+	library.CheckoutProject("1234", "Test Project", "host1", testFCPXBundlePath, map[string]string{})
+	t1 := time.Now().Unix()
+	library.Update(ProjectUpdate{Hostname: "host1", UUID: "1234", Last: t1, Event: "1-09-2019", Kind: CHANGE_EVENT_DB})
+	act := library.Projects["1234"].Activity["1-09-2019"]["host1"]
+	if act == nil || act.Last != t1 || act.Kind != CHANGE_EVENT_DB {
+		t.Fatalf("Expected event activity: %+v", library.Projects["1234"].Activity)
+	}
+}
+
+func Test_Library_Update_Background(t *testing.T) {
+	library := NewLibrary()
+	library.CheckoutProject("1234", "Test Project", "host1", testFCPXBundlePath, map[string]string{})
+	chk := library.Projects["1234"].Checkouts["host1"]
+	last, expires := chk.Last, chk.Expires
+	library.Update(ProjectUpdate{Hostname: "host1", UUID: "1234", Last: last + 3600, Event: "1-09-2019", Kind: CHANGE_RENDER, Source: SOURCE_BACKGROUND})
+	if chk.Last != last {
+		t.Fatal("Expected background updates not to count as an edit")
+	}
+	if chk.Expires < expires {
+		t.Fatal("Expected lease to be renewed")
+	}
+	if act := library.Projects["1234"].Activity["1-09-2019"]["host1"]; act == nil || act.Source != SOURCE_BACKGROUND {
+		t.Fatalf("Expected event activity: %+v", library.Projects["1234"].Activity)
+	}
+}
+
+func Test_Library_Forget_Activity(t *testing.T) {
+	library := NewLibrary()
+	library.CheckoutProject("1234", "Test Project", "host1", testFCPXBundlePath, map[string]string{})
+	library.CheckoutProject("1234", "Test Project", "host2", testFCPXBundlePath, map[string]string{})
+	now := time.Now().Unix()
+	library.Update(ProjectUpdate{Hostname: "host1", UUID: "1234", Last: now - 3600, Event: "1-09-2019", Kind: CHANGE_RENDER})
+	library.Update(ProjectUpdate{Hostname: "host1", UUID: "1234", Last: now, Event: "2-09-2019", Kind: CHANGE_EVENT_DB})
+	library.Update(ProjectUpdate{Hostname: "host2", UUID: "1234", Last: now - 7200, Event: "2-09-2019", Kind: CHANGE_EVENT_DB})
+
+	// Old activity is kept while the host has the library open
+	activity := library.Projects["1234"].Activity
+	if activity["1-09-2019"]["host1"] == nil {
+		t.Fatalf("Expected old activity to be kept: %+v", activity)
+	}
+
+	// And goes when it closes it
+	library.DeregisterProjects("host1", map[string]bool{})
+	activity = library.Projects["1234"].Activity
+	if _, hasKey := activity["1-09-2019"]; hasKey || activity["2-09-2019"]["host1"] != nil || activity["2-09-2019"]["host2"] == nil {
+		t.Fatalf("Expected only host2's activity: %+v", activity)
+	}
+}
+
+func Test_Usage_Report(t *testing.T) {
+
+	h := int64(3600)
+	events := []HistoryEvent{
+		{T: 0 * h, Kind: EVENT_CHECKOUT, UUID: "1234", Name: "Pepsi", Hostname: "suite1"},
+		{T: 1 * h, Kind: EVENT_UPDATE, UUID: "1234", Name: "Pepsi", Hostname: "suite1"},
+		{T: 2 * h, Kind: EVENT_CHECKOUT, UUID: "1234", Name: "Pepsi", Hostname: "suite2"},
+		{T: 3 * h, Kind: EVENT_CLOSE, UUID: "1234", Name: "Pepsi", Hostname: "suite1"},
+		{T: 4 * h, Kind: EVENT_CHECKOUT, UUID: "1234", Name: "Pepsi", Hostname: "suite1"},
+		{T: 5 * h, Kind: EVENT_EXPIRED, UUID: "1234", Name: "Pepsi", Hostname: "suite1"},
+		{T: 6 * h, Kind: EVENT_CHECKOUT, UUID: "5678", Name: "Coke", Hostname: "suite1"},
+		{T: 9 * h, Kind: EVENT_CLOSE, UUID: "5678", Name: "Coke", Hostname: "suite1"},
+	}
+
+	// suite2 never closed Pepsi, counted up to `until`. Coke is clipped to the range.
+	report := BuildUsageReport(events, 1*h, 8*h)
+	expected := []UsageRow{
+		{UUID: "5678", Name: "Coke", Hostname: "suite1", Checkouts: 1, Open: 2 * h, Hours: 2},
+		{UUID: "1234", Name: "Pepsi", Hostname: "suite1", Checkouts: 2, Open: 3 * h, Updates: 1, Active: historyUpdateInterval, Hours: 3},
+		{UUID: "1234", Name: "Pepsi", Hostname: "suite2", Checkouts: 1, Open: 6 * h, Hours: 6},
+	}
+	if !reflect.DeepEqual(report.Rows, expected) {
+		t.Fatal(report.Rows)
+	}
+	if len(report.Projects) != 2 || report.Projects[1].Open != 9*h || report.Projects[1].Hostname != "" {
+		t.Fatal(report.Projects)
+	}
+
+	b := &bytes.Buffer{}
+	report.CSV(b)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[3], "Pepsi,1234,suite2,1,6.00,0.00,0,") {
+		t.Fatal(b.String())
+	}
+
+}
@@ -36,7 +36,7 @@ func Test_Get_Open_Libraries(t *testing.T) {
 }
 
 func Test_FSWatch(t *testing.T) {
-	c := make(chan FCPLibrary, 1000)
+	c := make(chan ProjectUpdate, 1000)
 	ctx, cancel := context.WithCancel(context.Background())
 	i := 0
 	go func() {
@@ -63,3 +63,107 @@ func Test_FSWatch(t *testing.T) {
 		t.Errorf("Did not receive 5 change messages: %d\n", i)
 	}
 }
+
+func Test_Read_Library_Events(t *testing.T) {
+	events, err := ReadLibraryEvents(testFCPXBundlePath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(events) != 1 {
+		t.Fatal(events)
+	}
+	ev := events[0]
+	if ev.Name != "1-09-2019" || ev.Folder != "1-09-2019" {
+		t.Fatalf("Wrong event: %+v", ev)
+	}
+	if ev.ProjectCount != 0 || ev.ClipCount != 0 {
+		t.Fatalf("Expected an empty event: %+v", ev)
+	}
+	if time.Unix(ev.Modified, 0).Year() != 2019 {
+		t.Fatalf("Wrong modification time: %d", ev.Modified)
+	}
+}
+
+func Test_Bundle_Change(t *testing.T) {
+	cases := map[string][3]string{
+		"Users/me/projectx.fcpbundle/1-09-2019/CurrentVersion.fcpevent":               {"/Users/me/projectx.fcpbundle", "1-09-2019", CHANGE_EVENT_DB},
+		"Users/me/projectx.fcpbundle/CurrentVersion.flexolibrary-wal":                 {"/Users/me/projectx.fcpbundle", "", CHANGE_LIBRARY_DB},
+		"Users/me/projectx.fcpbundle/1-09-2019/Render Files/High Quality Media/a.mov": {"/Users/me/projectx.fcpbundle", "1-09-2019", CHANGE_RENDER},
+		"Users/me/projectx.fcpbundle/1-09-2019/Transcoded Media/Proxy Media/a.mov":    {"/Users/me/projectx.fcpbundle", "1-09-2019", CHANGE_TRANSCODE},
+		"Users/me/projectx.fcpbundle/__Temp/a.plist":                                  {"", "", ""},
+		"Users/me/Movies/a.mov": {"", "", ""},
+	}
+	for fp, expected := range cases {
+		bundle, event, kind := BundleChange(fp)
+		if bundle != expected[0] || event != expected[1] || kind != expected[2] {
+			t.Fatalf("%s => %s | %s | %s", fp, bundle, event, kind)
+		}
+	}
+}
+
+func Test_Bundle_UUIDs(t *testing.T) {
+	cache := &BundleUUIDs{Entries: map[string]string{}}
+	cache.Set("/Users/me/projectx.fcpbundle", "1234")
+	if uuid, err := cache.Get("/Users/me/projectx.fcpbundle"); err != nil || uuid != "1234" {
+		t.Fatal(uuid, err)
+	}
+
+	// A scan found another library at the same path
+	cache.Set("/Users/me/projectx.fcpbundle", "5678")
+	if uuid, _ := cache.Get("/Users/me/projectx.fcpbundle"); uuid != "5678" {
+		t.Fatal(uuid)
+	}
+
+	// And the next change after it closed reads the bundle again
+	cache.Forget(map[string]bool{})
+	if _, err := cache.Get("/Users/me/projectx.fcpbundle"); err == nil {
+		t.Fatal("Expected the closed bundle to be forgotten")
+	}
+}
+
+func Test_Update_Source(t *testing.T) {
+	cases := []struct {
+		kind     string
+		idle     int64
+		expected string
+	}{
+		{CHANGE_EVENT_DB, 5, SOURCE_USER},
+		{CHANGE_EVENT_DB, -1, SOURCE_USER},
+		{CHANGE_EVENT_DB, 3600, SOURCE_BACKGROUND},
+		{CHANGE_RENDER, 0, SOURCE_BACKGROUND},
+		{CHANGE_ANALYSIS, 0, SOURCE_BACKGROUND},
+		{CHANGE_MEDIA, 0, SOURCE_USER},
+	}
+	for _, c := range cases {
+		if source := UpdateSource(c.kind, c.idle); source != c.expected {
+			t.Fatalf("%s after %ds => %s", c.kind, c.idle, source)
+		}
+	}
+}
+
+func Test_Bundle_Storage(t *testing.T) {
+	storage := ScanStorage(testFCPXBundlePath)
+	if storage.Databases < 98304+90112 {
+		t.Fatalf("Expected both databases to be counted: %+v", storage)
+	}
+	sum := storage.Databases + storage.RenderFiles + storage.ProxyMedia + storage.OptimizedMedia +
+		storage.AnalysisFiles + storage.OriginalMedia + storage.Other
+	if sum != storage.Total {
+		t.Fatalf("Breakdown doesn't add up: %+v", storage)
+	}
+
+	cache := NewStorageCache()
+	cache.Scans = make(chan string, 1)
+	if cache.Get(testFCPXBundlePath) != nil {
+		t.Fatal("Expected the first scan to happen in the background")
+	}
+	select {
+	case <-cache.Scans:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Scan never finished")
+	}
+	cached := cache.Get(testFCPXBundlePath)
+	if cached == nil || cached.Total != storage.Total {
+		t.Fatalf("Expected cached storage: %+v", cached)
+	}
+}
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 func Test_Service(t *testing.T) {
@@ -43,3 +53,185 @@ func Test_Service(t *testing.T) {
 	h.Shutdown(context.TODO())
 
 }
+
+func Test_Signed_Requests(t *testing.T) {
+
+	teamSecret = []byte("hunter2")
+	defer func() { teamSecret = []byte{} }()
+
+	r := gin.New()
+	r.POST("/_checkout", Signed, func(c *gin.Context) {
+		b, _ := ioutil.ReadAll(c.Request.Body)
+		c.String(200, string(b))
+	})
+
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	body := []byte(`{"hostname":"host1"}`)
+
+	// Unsigned
+	req := httptest.NewRequest("POST", "/_checkout", bytes.NewReader(body))
+	if w := do(req); w.Code != http.StatusUnauthorized {
+		t.Fatal(w.Code)
+	}
+
+	// Signed, body still readable by the handler
+	req, _ = NewSignedRequest("POST", "http://localhost/_checkout", body)
+	signed := req.Header.Clone()
+	if w := do(req); w.Code != http.StatusOK || w.Body.String() != string(body) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	// Replayed
+	req = httptest.NewRequest("POST", "/_checkout", bytes.NewReader(body))
+	req.Header = signed
+	if w := do(req); w.Code != http.StatusUnauthorized {
+		t.Fatal(w.Code)
+	}
+
+	// Tampered body
+	req, _ = NewSignedRequest("POST", "http://localhost/_checkout", body)
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"hostname":"host2"}`)))
+	if w := do(req); w.Code != http.StatusUnauthorized {
+		t.Fatal(w.Code)
+	}
+
+	// Stale
+	req, _ = NewSignedRequest("POST", "http://localhost/_checkout", body)
+	if err := VerifyRequest(req, body, time.Now().Add(time.Minute)); err == nil {
+		t.Fatal("Accepted a stale request")
+	}
+
+	// A proof only vouches for the host that computed it
+	proof := Proof("challenge", "host1", 1234)
+	if proof == Proof("challenge", "host2", 1234) || proof == Proof("challenge", "host1", 4321) {
+		t.Fatal("Proof isn't bound to the responder")
+	}
+
+	// Wrong secret
+	teamSecret = []byte("hunter3")
+	req, _ = NewSignedRequest("POST", "http://localhost/_checkout", body)
+	teamSecret = []byte("hunter2")
+	if w := do(req); w.Code != http.StatusUnauthorized {
+		t.Fatal(w.Code)
+	}
+
+}
+
+func Test_TLS_Pinning(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "fcpxm")
+	defer os.RemoveAll(dir)
+
+	cert, fp, err := LoadOrCreateCertificate(dir, "martha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, again, err := LoadOrCreateCertificate(dir, "martha")
+	if err != nil || again != fp {
+		t.Fatal("Fingerprint changed across restarts", err)
+	}
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	r := gin.New()
+	r.GET("/_pong", func(c *gin.Context) {
+		c.String(200, "pong")
+	})
+	r.GET("/_scheme", func(c *gin.Context) {
+		if IsTLS(c.Request) {
+			c.String(200, "https")
+		} else {
+			c.String(200, "http")
+		}
+	})
+	go NewNodeServer(r).Serve(NewSniffListener(l, &tls.Config{Certificates: []tls.Certificate{cert}}))
+	defer l.Close()
+	addr := l.Addr().String()
+
+	get := func(c *http.Client, url string) error {
+		res, err := c.Get(url)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+
+	// Plain http still works on the same port, e.g. the dashboard
+	if err := get(NewHTTPTimeoutClient(), "http://"+addr+"/_pong"); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(NewPinnedClient(fp), "https://"+addr+"/_pong"); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(NewPinnedClient(strings.Repeat("0", 64)), "https://"+addr+"/_pong"); err == nil {
+		t.Fatal("Accepted the wrong certificate")
+	}
+	for scheme, c := range map[string]*http.Client{"http": NewHTTPTimeoutClient(), "https": NewPinnedClient(fp)} {
+		res, err := c.Get(scheme + "://" + addr + "/_scheme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(b) != scheme {
+			t.Fatalf("%s request seen as %s", scheme, string(b))
+		}
+	}
+
+	// With a certificate, plain http is only for /_ping and this machine
+	nodeCertificate = &cert
+	defer func() { nodeCertificate = nil }()
+	required := gin.New()
+	required.Use(RequireTLS)
+	required.HEAD("/_ping", func(c *gin.Context) {})
+	required.GET("/_shutdown", func(c *gin.Context) {})
+	cases := []struct {
+		method, path, remote string
+		expected             int
+	}{
+		{"GET", "/_shutdown", "192.0.2.1:1234", http.StatusForbidden},
+		{"HEAD", "/_ping", "192.0.2.1:1234", http.StatusOK},
+		{"GET", "/_shutdown", "127.0.0.1:1234", http.StatusOK},
+		{"GET", "/_shutdown", "[::1]:1234", http.StatusOK},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req.RemoteAddr = c.remote
+		required.ServeHTTP(w, req)
+		if w.Code != c.expected {
+			t.Fatalf("%s %s from %s => %d", c.method, c.path, c.remote, w.Code)
+		}
+	}
+
+	known := NewKnownHosts(filepath.Join(dir, KNOWN_HOSTS))
+	if err := known.Check("martha", fp); err != nil {
+		t.Fatal(err)
+	}
+	known.Pin("martha", fp)
+	reloaded := NewKnownHosts("")
+	reloaded.Load(filepath.Join(dir, KNOWN_HOSTS))
+	if reloaded.Get("martha") != fp {
+		t.Fatal(reloaded.Pins)
+	}
+	if err := reloaded.Check("martha", strings.Repeat("0", 64)); err == nil {
+		t.Fatal("Accepted a changed fingerprint")
+	}
+
+	// No downgrade to plain http
+	if err := reloaded.CheckPeer("martha", "", false); err == nil {
+		t.Fatal("Accepted a pinned host without a certificate")
+	}
+	if err := reloaded.CheckPeer("other", "", true); err == nil {
+		t.Fatal("Accepted a host without a certificate while requiring TLS")
+	}
+	if err := reloaded.CheckPeer("other", "", false); err != nil {
+		t.Fatal(err)
+	}
+
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
@@ -33,6 +34,91 @@ func Test_Get_Latest_Version(t *testing.T) {
 
 }
 
+func Test_Version_Ordering(t *testing.T) {
+
+	versions := []string{
+		"Pepsi Generation v4.mov",
+		"Pepsi Generation v3b.mov",
+		"Pepsi Generation v3.mov",
+		"Pepsi Generation_v012.mp4",
+		"Pepsi Generation v3a.mov",
+		"Pepsi Generation notes.txt",
+	}
+	expected := []string{"v3", "v3a", "v3b", "v4", "v012"}
+
+	found := []Deliverable{}
+	for _, fn := range versions {
+		d, ok := versionRules.Parse(fn)
+		if ok {
+			found = append(found, d)
+		}
+	}
+	SortDeliverables(found)
+	if len(found) != len(expected) {
+		t.Fatal(found)
+	}
+	for i, d := range found {
+		if d.Version != expected[i] {
+			t.Fatalf("Expected %s at %d: %s", expected[i], i, d.Version)
+		}
+	}
+
+	if v := GetLatestVersionName([]string{"Spot R2.mov", "Spot R3.mov", "Spot R10.mov"}); v != "Spot R10.mov" {
+		t.Fatal(v)
+	}
+	if v := GetLatestVersionName([]string{"Spot 2019-09-01.mov", "Spot 2019-10-01.mov", "Spot 2019-09-21.mov"}); v != "Spot 2019-10-01.mov" {
+		t.Fatal(v)
+	}
+
+	// A date doesn't outrank a version number
+	mixed := []Deliverable{}
+	for i, fn := range []string{"Spot 2019-09-01.mov", "Spot v2.mov", "Spot v3.mov"} {
+		d, _ := versionRules.Parse(fn)
+		d.Mtime = int64(i)
+		mixed = append(mixed, d)
+	}
+	SortDeliverables(mixed)
+	if mixed[2].Version != "v3" || mixed[1].Version != "v2" {
+		t.Fatal(mixed)
+	}
+
+	// Versions sort the same once they went through a checkout payload, even
+	// when older versions were modified last
+	reversed := []Deliverable{}
+	for i := len(found) - 1; i >= 0; i-- {
+		d := found[i]
+		d.Mtime = int64(len(reversed))
+		reversed = append(reversed, d)
+	}
+	b, _ := json.Marshal(reversed)
+	received := []Deliverable{}
+	json.Unmarshal(b, &received)
+	SortDeliverables(received)
+	for i, d := range received {
+		if d.Version != expected[i] {
+			t.Fatalf("Expected %s at %d after a round trip: %s", expected[i], i, d.Version)
+		}
+	}
+
+}
+
+func Test_Version_Rules(t *testing.T) {
+	rules, err := VersionRules{
+		Folders:  []string{`^Finals$`},
+		Patterns: []string{`(?i)_cut(?P<number>\d+)\.mov$`},
+	}.Compile()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !rules.IsOutputFolder("Finals") || rules.IsOutputFolder("Outputs") {
+		t.Fatal("Wrong output folders")
+	}
+	d, ok := rules.Parse("Spot_cut7.mov")
+	if !ok || d.Version != "cut7" {
+		t.Fatal(d)
+	}
+}
+
 func Test_USB_Activity(t *testing.T) {
 	fmt.Println("🖐 No touching of mouse or keyboard please...")
 	time.Sleep(7 * time.Second)
@@ -41,3 +127,34 @@ func Test_USB_Activity(t *testing.T) {
 		t.Fatal(elapsed)
 	}
 }
+
+func Test_Metrics_Text(t *testing.T) {
+
+	m := NewMetrics(map[string][2]string{
+		"test_total":   {"counter", "A counter."},
+		"test_seconds": {"summary", "A summary."},
+	})
+	m.Inc("test_total", "route", "_checkout", "result", "ok")
+	m.Inc("test_total", "route", "_checkout", "result", "ok")
+	m.Inc("test_total", "route", "notify", "result", `say "hi"`)
+	m.Observe("test_seconds", 0.5)
+	m.Observe("test_seconds", 1.5)
+
+	expected := `# HELP test_seconds A summary.
+# TYPE test_seconds summary
+test_seconds_sum 2
+test_seconds_count 2
+# HELP test_total A counter.
+# TYPE test_total counter
+test_total{route="_checkout",result="ok"} 2
+test_total{route="notify",result="say \"hi\""} 1
+`
+	if text := string(m.Text()); text != expected {
+		t.Fatal(text)
+	}
+
+	if r := metricRoute("_afk/host1/120"); r != "_afk" {
+		t.Fatal(r)
+	}
+
+}
@@ -3,9 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 func Test_Lag(t *testing.T) {
@@ -52,3 +59,676 @@ func Test_Alive(t *testing.T) {
 	}
 
 }
+
+func T_FakeServer() Server {
+	s := NewServer(Service{
+		Hostname: "nobody",
+		Port:     1234,
+		Members:  map[string]string{},
+	})
+	s.StorePath = ""
+	s.History = NewHistory("")
+	s.Inbox = NewInbox("")
+	return s
+}
+
+func T_FakePayload(hostname string) ClientPayload {
+	return ClientPayload{
+		Hostname:  hostname,
+		Port:      1234,
+		Libraries: FCPLibraries{"1234": T_FakeLibrary()},
+	}
+}
+
+func Test_Server_Reservation_Rejects(t *testing.T) {
+
+	s := T_FakeServer()
+	status, err := s.Library.Reserve(Reservation{UUID: "1234", Hostname: "host1"})
+	if err != nil {
+		t.Fatal(status, err.Error())
+	}
+
+	res := s.Checkout(T_FakePayload("host2"))
+	if len(res.Rejected) != 1 || res.Rejected[0].Holder != "host1" || res.Rejected[0].Status != http.StatusConflict {
+		t.Fatalf("Expected a rejection: %+v", res)
+	}
+	if s.Library.HasCheckout("1234", "host2") {
+		t.Fatal("Rejected host should not be checked out")
+	}
+
+	res = s.Checkout(T_FakePayload("host1"))
+	if len(res.Rejected) != 0 || len(res.Checkouts) != 1 {
+		t.Fatalf("Expected holder to check out: %+v", res)
+	}
+
+	if _, err := s.Library.Reserve(Reservation{UUID: "1234", Hostname: "host2"}); err == nil {
+		t.Fatal("Expected reservation conflict")
+	}
+
+	// A host that had it open before the reservation is rejected but not closed
+	open := T_FakeServer()
+	open.Checkout(T_FakePayload("host2"))
+	open.Library.Reserve(Reservation{UUID: "1234", Hostname: "host1"})
+	res = open.Checkout(T_FakePayload("host2"))
+	if len(res.Rejected) != 1 || !open.Library.HasCheckout("1234", "host2") {
+		t.Fatalf("Expected the checkout to be kept: %+v", res)
+	}
+	if closes := open.History.Query(HistoryFilter{Kind: EVENT_CLOSE}); len(closes) != 0 {
+		t.Fatal(closes)
+	}
+
+}
+
+func Test_Server_Conflict_Notifications(t *testing.T) {
+
+	received := make(chan string, 100)
+	receiver := func(hostname string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m := NotifyMessage{}
+			json.NewDecoder(r.Body).Decode(&m)
+			received <- hostname + ": " + m.Message
+		}))
+	}
+	h1, h2 := receiver("host1"), receiver("host2")
+	defer h1.Close()
+	defer h2.Close()
+
+	s := T_FakeServer()
+	s.Service.Members["host1"] = h1.URL
+	s.Service.Members["host2"] = h2.URL
+
+	count := func() int {
+		time.Sleep(500 * time.Millisecond)
+		n := len(received)
+		for i := 0; i < n; i++ {
+			t.Log(<-received)
+		}
+		return n
+	}
+
+	s.Checkout(T_FakePayload("host1"))
+	s.Checkout(T_FakePayload("host2"))
+	if n := count(); n != 2 {
+		t.Fatalf("Expected both hosts to be notified: %d", n)
+	}
+
+	// Reporting again doesn't notify again
+	s.Checkout(T_FakePayload("host1"))
+	s.Checkout(T_FakePayload("host2"))
+	if n := count(); n != 0 {
+		t.Fatalf("Expected no repeat notifications: %d", n)
+	}
+
+	// host2 closes the library, host1 is told
+	s.Checkout(ClientPayload{Hostname: "host2", Libraries: FCPLibraries{}})
+	if n := count(); n != 1 {
+		t.Fatalf("Expected a follow up notification: %d", n)
+	}
+	if len(s.Conflicts) != 0 {
+		t.Fatal(s.Conflicts)
+	}
+
+}
+
+func Test_Server_Version_Timeline(t *testing.T) {
+
+	v1 := Deliverable{Name: "Spot v1.mov", Folder: "Outputs", Size: 100, Mtime: 1}
+	v2 := Deliverable{Name: "Spot v2.mov", Folder: "Outputs", Size: 100, Mtime: 2}
+	v2b := v2
+	v2b.Size, v2b.Mtime = 200, 3
+
+	v2partial := v2
+	v2partial.Size = 50
+
+	watch := NewDeliverableWatch()
+	scan := func(versions ...Deliverable) []DeliverableUpdate {
+		return watch.Scan(FCPLibraries{"1234": &FCPLibrary{Name: "Spot", Versions: versions}})
+	}
+	// Opened with v1, then v2 is exported and only reported once it stops changing
+	for i, versions := range [][]Deliverable{{v1}, {v1, v2partial}, {v1, v2}} {
+		if updates := scan(versions...); len(updates) != 0 {
+			t.Fatal(i, updates)
+		}
+	}
+	updates := scan(v1, v2)
+	if len(updates) != 1 || updates[0].Deliverable.Name != v2.Name || updates[0].Replaced {
+		t.Fatal(updates)
+	}
+	if updates := scan(v1, v2); len(updates) != 0 {
+		t.Fatal(updates)
+	}
+	scan(v1, v2b)
+	updates = scan(v1, v2b)
+	if len(updates) != 1 || !updates[0].Replaced {
+		t.Fatal(updates)
+	}
+
+	s := T_FakeServer()
+	for _, d := range []Deliverable{v1, v2, v2, v2b} {
+		s.Library.AddVersion(DeliverableUpdate{Hostname: "host1", UUID: "1234", Deliverable: d})
+	}
+	if n := len(s.Library.Timelines["1234"]); n != 3 {
+		t.Fatalf("Expected 3 versions in the timeline: %d", n)
+	}
+
+	// Replacing the same file twice in a row is one replacement
+	v2c, v2d := v2, v2
+	v2c.Size, v2d.Size = 300, 400
+	for _, d := range []Deliverable{v2c, v2d} {
+		s.Library.AddVersion(DeliverableUpdate{Hostname: "host1", UUID: "1234", Deliverable: d, Replaced: true})
+	}
+	timeline := s.Library.Timelines["1234"]
+	if len(timeline) != 4 || timeline[3].Size != 400 {
+		t.Fatal(timeline)
+	}
+
+}
+
+func Test_Server_API(t *testing.T) {
+
+	s := T_FakeServer()
+	s.Checkout(T_FakePayload("host1"))
+	s.Checkout(T_FakePayload("host2"))
+
+	r := gin.New()
+	r.GET("/projects/:uuid", s.GET_Project)
+	r.GET("/hosts/:hostname", s.GET_Host)
+	r.DELETE("/projects/:uuid/checkouts/:host", s.DELETE_ProjectCheckout)
+
+	request := func(method, url string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		body := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	status, body := request("GET", "/projects/1234")
+	if status != http.StatusOK || body["conflict"] == nil {
+		t.Fatal(status, body)
+	}
+
+	status, body = request("GET", "/hosts/host2")
+	if status != http.StatusOK || len(body["checkouts"].(map[string]interface{})) != 1 {
+		t.Fatal(status, body)
+	}
+
+	status, body = request("DELETE", "/projects/1234/checkouts/host2")
+	if status != http.StatusOK || s.Library.HasCheckout("1234", "host2") || len(s.Conflicts) != 0 {
+		t.Fatal(status, body)
+	}
+
+	status, body = request("DELETE", "/projects/1234/checkouts/host2")
+	if status != http.StatusNotFound || body["error"] == nil || body["status"].(float64) != http.StatusNotFound {
+		t.Fatal(status, body)
+	}
+
+	status, _ = request("GET", "/hosts/nobody")
+	if status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+
+}
+
+func Test_Server_Deferred_Save(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fcpxmonitor")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s := T_FakeServer()
+	s.StorePath = filepath.Join(dir, LIBRARY_STORE)
+	s.Checkout(T_FakePayload("host1"))
+
+	r := gin.New()
+	r.POST("/_update", s.POST_Update)
+	last := time.Now().Unix()
+	b, _ := json.Marshal(ProjectUpdate{Hostname: "host1", UUID: "1234", Last: last})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/_update", strings.NewReader(string(b))))
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	stored := func() int64 {
+		library := NewLibrary()
+		err := library.Load(s.StorePath)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return library.Projects["1234"].Checkouts["host1"].Last
+	}
+	if stored() == last {
+		t.Fatal("Expected the update to wait for the next flush")
+	}
+	s.FlushLibrary()
+	if stored() != last {
+		t.Fatal("Expected the update to be flushed")
+	}
+
+}
+
+func Test_Server_Event_Stream(t *testing.T) {
+
+	s := T_FakeServer()
+	ch := s.Broker.Subscribe()
+	defer s.Broker.Unsubscribe(ch)
+
+	s.Checkout(T_FakePayload("host1"))
+	s.Checkout(T_FakePayload("host2"))
+
+	kinds := []string{}
+	for len(ch) > 0 {
+		kinds = append(kinds, (<-ch).Kind)
+	}
+	if strings.Join(kinds, ",") != "checkout,checkout,conflict" {
+		t.Fatal(kinds)
+	}
+
+	s.Service.SetMember("host3", "http://host3:8080", StringMap{})
+	s.DiffMembers()
+	s.Service.RemoveMember("host3")
+	s.DiffMembers()
+	if ev := <-ch; ev.Kind != EVENT_JOIN || ev.Hostname != "host3" {
+		t.Fatal(ev)
+	}
+	if ev := <-ch; ev.Kind != EVENT_LEAVE || ev.Hostname != "host3" {
+		t.Fatal(ev)
+	}
+
+}
+
+func Test_Server_Replication(t *testing.T) {
+
+	a := T_FakeServer()
+	b := T_FakeServer()
+
+	exchange := func(from, to *Server) {
+		from.Library.Lock()
+		snapshot, _ := json.Marshal(&from.Library)
+		from.Library.Unlock()
+		res, err := to.MergeReplica(snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from.MergeReplica(res)
+	}
+
+	// b started late and only a saw the checkouts
+	a.Checkout(T_FakePayload("host1"))
+	a.Checkout(T_FakePayload("host2"))
+	a.Library.Reserve(Reservation{UUID: "1234", Hostname: "host1"})
+	exchange(&a, &b)
+	if !b.Library.HasCheckout("1234", "host1") || !b.Library.HasCheckout("1234", "host2") || len(b.Conflicts) != 1 {
+		t.Fatal(b.Library.Projects, b.Conflicts)
+	}
+	if _, hasKey := b.Library.Reservations["1234"]; !hasKey {
+		t.Fatal(b.Library.Reservations)
+	}
+
+	// Activity only moves forward, wherever it was reported
+	b.Library.Update(ProjectUpdate{Hostname: "host1", UUID: "1234", Last: 2000000000})
+	exchange(&b, &a)
+	if a.Library.Projects["1234"].Checkouts["host1"].Last != 2000000000 {
+		t.Fatal(a.Library.Projects["1234"].Checkouts["host1"])
+	}
+
+	// Metadata reported to either server replicates with the project
+	renamed := T_FakePayload("host1")
+	renamed.Libraries["1234"].Events = []FCPEvent{{Name: "Day 2", Folder: "Day 2"}}
+	b.Checkout(renamed)
+	exchange(&b, &a)
+	if events := a.Library.Projects["1234"].Events; len(events) != 1 || events[0].Name != "Day 2" {
+		t.Fatal(events)
+	}
+
+	// A close on one server leaves a tombstone that wins over the stale copy
+	noLibraries := T_FakePayload("host2")
+	noLibraries.Libraries = FCPLibraries{}
+	b.Checkout(noLibraries)
+	exchange(&a, &b)
+	if a.Library.HasCheckout("1234", "host2") || b.Library.HasCheckout("1234", "host2") || len(a.Conflicts) != 0 {
+		t.Fatal(a.Library.Projects["1234"].Checkouts, b.Library.Projects["1234"].Checkouts)
+	}
+
+	a.Library.Release("1234")
+	exchange(&b, &a)
+	if len(b.Library.Reservations) != 0 {
+		t.Fatal(b.Library.Reservations)
+	}
+
+	// And a newer checkout wins over the tombstone
+	a.Checkout(T_FakePayload("host2"))
+	exchange(&b, &a)
+	if !b.Library.HasCheckout("1234", "host2") {
+		t.Fatal(b.Library.Projects["1234"].Checkouts)
+	}
+
+	// Pushes are batched
+	a.MarkDirty()
+	a.MarkDirty()
+	a.ReplicateDirty()
+	if len(a.ReplicateChan) != 0 {
+		t.Fatal("Expected the pending push to be sent")
+	}
+
+	// Only one of the pair notifies clients
+	s1, s2 := T_FakeServer(), T_FakeServer()
+	s1.Hostname, s2.Hostname = "server1", "server2"
+	s1.Peers.SetMember("server2", "http://server2:8080", StringMap{})
+	s2.Peers.SetMember("server1", "http://server1:8080", StringMap{})
+	if !s1.IsSender() || s2.IsSender() {
+		t.Fatal("Expected server1 to be the only sender")
+	}
+	s2.AWOL["server1"] = time.Now()
+	if !s2.IsSender() {
+		t.Fatal("Expected server2 to take over from an unreachable server1")
+	}
+
+}
+
+func Test_Server_Webhooks(t *testing.T) {
+
+	received := make(chan string, 10)
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures -= 1
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- string(b)
+	}))
+	defer receiver.Close()
+
+	hook := &Webhook{
+		Name:     "chat",
+		URL:      receiver.URL,
+		Events:   []string{EVENT_CONFLICT},
+		Template: `{"text": {{json (printf "%s: %s" .Name .Detail)}}}`,
+		Backoff:  "10ms",
+	}
+	if err := hook.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := T_FakeServer()
+	s.Webhooks = NewWebhooks([]*Webhook{hook})
+	s.Checkout(T_FakePayload("host1"))
+	s.Checkout(T_FakePayload("host2"))
+
+	select {
+	case body := <-received:
+		if !strings.HasPrefix(body, `{"text": "Test Project: `) {
+			t.Fatal(body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook never delivered")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	s.Webhooks.Lock()
+	defer s.Webhooks.Unlock()
+	if len(s.Webhooks.Log) != 1 || s.Webhooks.Log[0].Attempts != 2 || s.Webhooks.Log[0].Status != 200 {
+		t.Fatal(s.Webhooks.Log)
+	}
+
+	// "retries": 0 means no retries, not the default
+	for b, expected := range map[string]int{`{"url": "http://a", "retries": 0}`: 0, `{"url": "http://a"}`: WEBHOOK_DEFAULT_RETRIES} {
+		hook := &Webhook{}
+		json.Unmarshal([]byte(b), hook)
+		if err := hook.Compile(); err != nil || hook.retries != expected {
+			t.Fatal(b, hook.retries, err)
+		}
+	}
+
+}
+
+func Test_Server_Targeted_Broadcast(t *testing.T) {
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"notify":"ok"}`))
+	}))
+	defer ok.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	gone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	gone.Close()
+
+	s := T_FakeServer()
+	s.Service.Members["host1"] = ok.URL
+	s.Service.Members["host2"] = broken.URL
+	s.Service.Members["host3"] = gone.URL
+	s.Groups = Groups{"suites": []string{"host1", "host4"}}
+	s.Checkout(T_FakePayload("host1"))
+	s.Checkout(T_FakePayload("host2"))
+
+	r := gin.New()
+	r.POST("/broadcast", s.POST_Broadcast)
+	broadcast := func(body string) (int, MessageResult) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/broadcast", strings.NewReader(body)))
+		res := MessageResult{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+
+	status, res := broadcast(`{"message":"hi"}`)
+	if status != 200 || len(res.Recipients) != 3 || res.Delivered != 1 ||
+		res.Recipients["host2"].Status != HTTP_ERROR || res.Recipients["host2"].Code != 500 ||
+		res.Recipients["host3"].Status != UNREACHABLE {
+		t.Fatal(status, res)
+	}
+
+	status, res = broadcast(`{"message":"hi","uuid":"1234"}`)
+	if status != 200 || len(res.Recipients) != 2 || res.Recipients["host1"].Status != DELIVERED {
+		t.Fatal(status, res)
+	}
+
+	status, res = broadcast(`{"message":"hi","group":"suites","hosts":["host3"]}`)
+	if status != 200 || len(res.Recipients) != 3 || res.Recipients["host4"].Status != UNREACHABLE || res.Failed != 2 {
+		t.Fatal(status, res)
+	}
+
+	if status, _ = broadcast(`{"message":"hi","group":"nope"}`); status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+
+}
+
+func Test_Server_Inbox(t *testing.T) {
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	asleep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	asleep.Close()
+
+	s := T_FakeServer()
+	s.Service.Members["host1"] = ok.URL
+	s.Service.Members["host2"] = asleep.URL
+
+	r := gin.New()
+	r.POST("/broadcast", s.POST_Broadcast)
+	r.GET("/messages", s.GET_Messages)
+	r.GET("/_inbox/:hostname", s.GET_Inbox)
+	r.POST("/_inbox/:hostname/ack", s.POST_InboxAck)
+	request := func(method, url, body string) []byte {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		if w.Code != 200 {
+			t.Fatal(method, url, w.Code, w.Body.String())
+		}
+		return w.Body.Bytes()
+	}
+
+	request("POST", "/broadcast", `{"message":"Lunch is here"}`)
+
+	pending := []InboxMessage{}
+	json.Unmarshal(request("GET", "/_inbox/host1", ""), &pending)
+	if len(pending) != 0 {
+		t.Fatal(pending)
+	}
+	json.Unmarshal(request("GET", "/_inbox/host2", ""), &pending)
+	if len(pending) != 1 || pending[0].Message != "Lunch is here" {
+		t.Fatal(pending)
+	}
+
+	request("POST", "/_inbox/host2/ack", `{"ids":["`+pending[0].ID+`"]}`)
+	json.Unmarshal(request("GET", "/_inbox/host2", ""), &pending)
+	if len(pending) != 0 {
+		t.Fatal(pending)
+	}
+
+	messages := struct {
+		Messages []InboxMessage `json:"messages"`
+	}{}
+	json.Unmarshal(request("GET", "/messages?hostname=host2", ""), &messages)
+	if len(messages.Messages) != 1 || messages.Messages[0].Recipients["host2"].Status != DELIVERED {
+		t.Fatal(messages)
+	}
+
+}
+
+func Test_Server_Sessions(t *testing.T) {
+
+	s := T_FakeServer()
+	s.Sessions.Idle = 10 * time.Minute
+	s.Checkout(T_FakePayload("host1"))
+
+	now := time.Now().Unix()
+	update := func(last int64) {
+		s.Library.Lock()
+		defer s.Library.Unlock()
+		s.Library.Update(ProjectUpdate{Hostname: "host1", UUID: "1234", Last: last})
+		s.RecordSessions(s.Sessions.Activity("host1", "1234", "Test Project", last))
+	}
+
+	update(now - 3600)
+	update(now - 3000)
+	// 50 minutes of silence, the first session ends at its last activity
+	update(now - 120)
+	update(now - 60)
+
+	sessions := s.QuerySessions("", "host1", 0)
+	if len(sessions) != 2 || sessions[0].Reason != SESSION_IDLE || sessions[0].Duration(now) != 600 || sessions[1].End != 0 {
+		t.Fatal(sessions)
+	}
+
+	// Closing the library ends the open session
+	noLibraries := T_FakePayload("host1")
+	noLibraries.Libraries = FCPLibraries{}
+	s.Checkout(noLibraries)
+	sessions = s.QuerySessions("1234", "", 0)
+	if len(sessions) != 2 || sessions[1].Reason != SESSION_CLOSED || sessions[1].Start != now-120 || len(s.Sessions.List()) != 0 {
+		t.Fatal(sessions)
+	}
+
+	sheet := BuildTimesheet(sessions, now-3300, now)
+	if len(sheet.Totals) != 1 || sheet.Totals[0].Sessions != 2 || sheet.Totals[0].Seconds != 300+sessions[1].Duration(now) {
+		t.Fatal(sheet.Totals)
+	}
+
+	// Going AFK past the threshold ends sessions when the host went idle
+	s.Sessions.Activity("host2", "1234", "Test Project", now-1000)
+	if ended := s.Sessions.Away("host2", 300, now); len(ended) != 0 {
+		t.Fatal(ended)
+	}
+	ended := s.Sessions.Away("host2", 900, now)
+	if len(ended) != 1 || ended[0].End != now-900 {
+		t.Fatal(ended)
+	}
+
+}
+
+func Test_Server_Calendar(t *testing.T) {
+
+	sessions := []Session{
+		{Hostname: "suite2", UUID: "1234", Name: "Pepsi, Generation.fcpbundle", Start: 1567339200, End: 1567346400, Updates: 40, Reason: SESSION_IDLE},
+		{Hostname: "suite2", UUID: "5678", Name: "Coke.fcpbundle", Start: 1567350000, Updates: 2},
+	}
+	ics := string(Calendar("FCPX suite2", sessions, 1567353600))
+
+	for _, expected := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"X-WR-CALNAME:FCPX suite2\r\n",
+		"DTSTART:20190901T120000Z\r\nDTEND:20190901T140000Z\r\n",
+		`SUMMARY:Pepsi\, Generation · suite2` + "\r\n",
+		"DTEND:20190901T160000Z\r\nSUMMARY:Coke · suite2 (in progress)\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(ics, expected) {
+			t.Fatal(expected, ics)
+		}
+	}
+	if strings.Count(ics, "BEGIN:VEVENT") != 2 {
+		t.Fatal(ics)
+	}
+	for _, line := range strings.Split(ics, "\r\n") {
+		if len(line) > ICAL_MAX_LINE_OCTETS {
+			t.Fatal(line)
+		}
+	}
+
+}
+
+func Test_Server_Presence(t *testing.T) {
+
+	s := T_FakeServer()
+	now := time.Now().Unix()
+
+	sample := func(idle int, at int64) {
+		if change, changed := s.AFK.Sample("host1", idle, at); changed {
+			s.RecordPresence(change)
+		}
+	}
+	sample(5, now-1200)
+	sample(30, now-1140)
+	sample(200, now-960)
+	sample(700, now-600)
+	sample(10, now-540)
+
+	p := s.AFK.State("host1")
+	if p.State != PRESENCE_ACTIVE || p.Since != now-540 || p.Last != now-540 || len(s.AFK.Samples["host1"]) != 5 {
+		t.Fatal(p, s.AFK.Samples["host1"])
+	}
+	transitions := s.History.Query(HistoryFilter{Kind: EVENT_PRESENCE})
+	details := []string{}
+	for _, ev := range transitions {
+		details = append(details, ev.Detail)
+	}
+	if strings.Join(details, ",") != "offline>active,active>idle,idle>away,away>active" {
+		t.Fatal(details)
+	}
+
+	// No samples for longer than OFFLINE_AFTER
+	s.RecordPresence(s.AFK.Sweep(now)...)
+	if p := s.AFK.State("host1"); p.State != PRESENCE_OFFLINE || p.Since != now-540 {
+		t.Fatal(p)
+	}
+	if _, hasKey := s.AFK.Map["host1"]; hasKey {
+		t.Fatal(s.AFK.Map)
+	}
+
+	// Leaving the network
+	sample(0, now)
+	s.KnownMembers["host1"] = true
+	s.DiffMembers()
+	if p := s.AFK.State("host1"); p.State != PRESENCE_OFFLINE {
+		t.Fatal(p)
+	}
+	if n := len(s.History.Query(HistoryFilter{Kind: EVENT_PRESENCE})); n != 7 {
+		t.Fatal(n)
+	}
+
+	// Old samples are dropped
+	sample(0, now+int64(AFK_RETENTION.Seconds())+1)
+	if len(s.AFK.Samples["host1"]) != 1 {
+		t.Fatal(s.AFK.Samples["host1"])
+	}
+
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EVENT_PRESENCE = "presence"
+
+	PRESENCE_ACTIVE  = "active"
+	PRESENCE_IDLE    = "idle"
+	PRESENCE_AWAY    = "away"
+	PRESENCE_OFFLINE = "offline"
+
+	IDLE_AFTER    = 2 * time.Minute  // of no USB activity
+	AWAY_AFTER    = 10 * time.Minute // of no USB activity
+	OFFLINE_AFTER = 5 * time.Minute  // without a sample, clients send one every minute
+	AFK_RETENTION = 24 * time.Hour   // of samples kept per host
+)
+
+type AFKSample struct {
+	T    int64 `json:"t"`
+	Idle int   `json:"idle"` // seconds
+}
+
+type Presence struct {
+	State string `json:"state"` // See PRESENCE_*
+	Since int64  `json:"since"` // When it entered this state
+	Last  int64  `json:"last"`  // Last sample
+}
+
+type PresenceChange struct {
+	Hostname string
+	From     string
+	To       string
+}
+
+func NewAFK() AFK {
+	return AFK{
+		Map:      map[string]int{},
+		Samples:  map[string][]AFKSample{},
+		Presence: map[string]*Presence{},
+	}
+}
+
+// AFK keeps how long each host has been away from its keyboard and mouse
+type AFK struct {
+	sync.Mutex
+	Map      map[string]int // Latest idle seconds
+	Samples  map[string][]AFKSample
+	Presence map[string]*Presence
+}
+
+func PresenceFor(idle int) string {
+	switch {
+	case time.Duration(idle)*time.Second >= AWAY_AFTER:
+		return PRESENCE_AWAY
+	case time.Duration(idle)*time.Second >= IDLE_AFTER:
+		return PRESENCE_IDLE
+	}
+	return PRESENCE_ACTIVE
+}
+
+// set moves a host to `state`. The caller must hold the lock.
+func (self *AFK) set(hostname, state string, at int64) (PresenceChange, bool) {
+	p, hasKey := self.Presence[hostname]
+	if !hasKey {
+		p = &Presence{State: PRESENCE_OFFLINE}
+		self.Presence[hostname] = p
+	}
+	if p.State == state {
+		return PresenceChange{}, false
+	}
+	change := PresenceChange{Hostname: hostname, From: p.State, To: state}
+	p.State = state
+	p.Since = at
+	return change, true
+}
+
+// Sample records an idle time reported by a host
+func (self *AFK) Sample(hostname string, idle int, now int64) (PresenceChange, bool) {
+	self.Lock()
+	defer self.Unlock()
+	self.Map[hostname] = idle
+	samples := append(self.Samples[hostname], AFKSample{T: now, Idle: idle})
+	cutoff := now - int64(AFK_RETENTION.Seconds())
+	i := sort.Search(len(samples), func(i int) bool {
+		return samples[i].T >= cutoff
+	})
+	self.Samples[hostname] = samples[i:]
+	// The host went idle `idle` seconds ago, not when it told us
+	at := now
+	state := PresenceFor(idle)
+	if state != PRESENCE_ACTIVE {
+		at = now - int64(idle)
+	}
+	change, changed := self.set(hostname, state, at)
+	self.Presence[hostname].Last = now
+	return change, changed
+}
+
+// Offline marks a host offline e.g. it left the network
+func (self *AFK) Offline(hostname string, now int64) (PresenceChange, bool) {
+	self.Lock()
+	defer self.Unlock()
+	delete(self.Map, hostname)
+	if _, hasKey := self.Presence[hostname]; !hasKey {
+		return PresenceChange{}, false
+	}
+	return self.set(hostname, PRESENCE_OFFLINE, now)
+}
+
+// Sweep marks hosts that stopped sending samples offline
+func (self *AFK) Sweep(now int64) []PresenceChange {
+	self.Lock()
+	defer self.Unlock()
+	changes := []PresenceChange{}
+	for hostname, p := range self.Presence {
+		if p.State != PRESENCE_OFFLINE && now-p.Last > int64(OFFLINE_AFTER.Seconds()) {
+			delete(self.Map, hostname)
+			change, _ := self.set(hostname, PRESENCE_OFFLINE, p.Last)
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// State of a host, offline if it never reported
+func (self *AFK) State(hostname string) Presence {
+	self.Lock()
+	defer self.Unlock()
+	p, hasKey := self.Presence[hostname]
+	if !hasKey {
+		return Presence{State: PRESENCE_OFFLINE}
+	}
+	return *p
+}
+
+// RecordPresence writes presence transitions to history
+func (self *Server) RecordPresence(changes ...PresenceChange) {
+	for _, change := range changes {
+		self.Record(EVENT_PRESENCE, "", "", change.Hostname, change.From+">"+change.To)
+	}
+}
+
+// SweepPresence is called every minute, see Server.Start
+func (self *Server) SweepPresence() {
+	self.RecordPresence(self.AFK.Sweep(time.Now().Unix())...)
+}
+
+func (self *Server) GET_AFK(c *gin.Context) {
+	hostname := c.Param("hostname")
+	secondsaway, err := strconv.Atoi(c.Param("secondsaway"))
+	if err != nil || secondsaway < 0 {
+		// LastUSBActivity returns -1 when ioreg fails
+		JSONError(c, http.StatusBadRequest, "Invalid idle time: "+c.Param("secondsaway"))
+		return
+	}
+	now := time.Now().Unix()
+	change, changed := self.AFK.Sample(hostname, secondsaway, now)
+	self.Publish(EVENT_AFK, "", "", hostname, strconv.Itoa(secondsaway))
+	if changed {
+		self.RecordPresence(change)
+	}
+	self.RecordSessions(self.Sessions.Away(hostname, int64(secondsaway), now))
+	c.String(200, "ok")
+}
+
+func (self *Server) GET_AFKs(c *gin.Context) {
+	self.AFK.Lock()
+	defer self.AFK.Unlock()
+	c.JSON(200, self.AFK.Map)
+}
+
+type AFKHistory struct {
+	Presence    Presence       `json:"presence"`
+	Samples     []AFKSample    `json:"samples"`
+	Transitions []HistoryEvent `json:"transitions"`
+}
+
+func (self *Server) GET_AFKHistory(c *gin.Context) {
+
+	since, err := ParseTime(c.Query("since"))
+	if err != nil {
+		JSONError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	hostname := c.Query("hostname")
+
+	res := map[string]*AFKHistory{}
+	self.AFK.Lock()
+	for host, p := range self.AFK.Presence {
+		if hostname != "" && host != hostname {
+			continue
+		}
+		samples := []AFKSample{}
+		for _, sample := range self.AFK.Samples[host] {
+			if sample.T >= since {
+				samples = append(samples, sample)
+			}
+		}
+		res[host] = &AFKHistory{Presence: *p, Samples: samples, Transitions: []HistoryEvent{}}
+	}
+	self.AFK.Unlock()
+
+	// Transitions outlive the samples, they're in history
+	filter := HistoryFilter{Hostname: hostname, Kind: EVENT_PRESENCE, Since: since}
+	for _, ev := range self.History.Query(filter) {
+		h, hasKey := res[ev.Hostname]
+		if !hasKey {
+			h = &AFKHistory{Presence: Presence{State: PRESENCE_OFFLINE}, Samples: []AFKSample{}, Transitions: []HistoryEvent{}}
+			res[ev.Hostname] = h
+		}
+		h.Transitions = append(h.Transitions, ev)
+	}
+
+	c.JSON(200, res)
+
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EVENT_RELEASED = "released"
+)
+
+// JSONError is the one error body every endpoint returns
+func JSONError(c *gin.Context, status int, msg string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": msg, "status": status})
+}
+
+type ProjectResource struct {
+	UUID        string         `json:"uuid"`
+	Project     *Project       `json:"project"`
+	Reservation *Reservation   `json:"reservation"`
+	Conflict    *Conflict      `json:"conflict"`
+	Timeline    []VersionEvent `json:"timeline"`
+}
+
+type HostCheckout struct {
+	Name string `json:"name"`
+	Checkout
+}
+
+type HostResource struct {
+	Hostname  string                  `json:"hostname"`
+	Member    bool                    `json:"member"`
+	URL       string                  `json:"url"`
+	Version   string                  `json:"version"`
+	RTT       float64                 `json:"rtt"`  // milliseconds, 0 if never measured
+	AWOL      int64                   `json:"awol"` // unix time first unreachable, 0 if reachable
+	AFK       int                     `json:"afk"`  // seconds, -1 if never reported
+	Checkouts map[string]HostCheckout `json:"checkouts"`
+}
+
+// ReleaseCheckout force-removes a host's checkout, and the project if nobody else has it
+func (self *Library) ReleaseCheckout(uuid, host string) (removed bool, status int, err error) {
+	if !self.HasProject(uuid) {
+		return false, http.StatusNotFound, errors.New("Project does not exist: " + uuid)
+	}
+	if !self.HasCheckout(uuid, host) {
+		return false, http.StatusNotFound, errors.New(fmt.Sprintf("No checkout of %s from %s", uuid, host))
+	}
+	delete(self.Projects[uuid].Checkouts, host)
+	self.Projects[uuid].ForgetActivity(host)
+	self.Touch(STAMP_CHECKOUT, uuid, host, true)
+	if len(self.Projects[uuid].Checkouts) == 0 {
+		delete(self.Projects, uuid)
+		return true, 0, nil
+	}
+	return false, 0, nil
+}
+
+func (self *Server) GET_Projects(c *gin.Context) {
+	self.Library.Lock()
+	defer self.Library.Unlock()
+	uuids := []string{}
+	for uuid, _ := range self.Library.Projects {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	c.JSON(http.StatusOK, gin.H{"projects": uuids})
+}
+
+func (self *Server) GET_Project(c *gin.Context) {
+
+	uuid := c.Param("uuid")
+
+	self.Library.Lock()
+	defer self.Library.Unlock()
+
+	project, hasKey := self.Library.Projects[uuid]
+	timeline, hasTimeline := self.Library.Timelines[uuid]
+	if !hasKey && !hasTimeline {
+		JSONError(c, http.StatusNotFound, "Project does not exist: "+uuid)
+		return
+	}
+
+	res := ProjectResource{
+		UUID:     uuid,
+		Project:  project,
+		Timeline: timeline,
+	}
+	if res.Timeline == nil {
+		res.Timeline = []VersionEvent{}
+	}
+	if r, hasKey := self.Library.Reservations[uuid]; hasKey {
+		res.Reservation = r
+	}
+	if conflict, hasKey := self.Conflicts[uuid]; hasKey {
+		res.Conflict = &conflict
+	}
+
+	c.JSON(http.StatusOK, res)
+
+}
+
+func (self *Server) DELETE_ProjectCheckout(c *gin.Context) {
+
+	uuid, host := c.Param("uuid"), c.Param("host")
+
+	self.Library.Lock()
+	defer self.Library.Unlock()
+
+	name := ""
+	if self.Library.HasProject(uuid) {
+		name = self.Library.Projects[uuid].Name
+	}
+
+	removed, status, err := self.Library.ReleaseCheckout(uuid, host)
+	if err != nil {
+		JSONError(c, status, err.Error())
+		return
+	}
+
+	log.Printf("✂️ [%s] [RELEASED] %s", host, uuid)
+	self.Record(EVENT_RELEASED, uuid, name, host, "forced")
+	if removed {
+		self.Record(EVENT_REMOVE, uuid, name, host, "")
+	}
+	self.ReconcileConflicts()
+	self.SaveLibrary()
+
+	go self.Notify(host, fmt.Sprintf("✂️ Your checkout of '%s' was released", name))
+
+	c.JSON(http.StatusOK, gin.H{"released": host, "uuid": uuid, "removed": removed})
+
+}
+
+func (self *Server) GET_Hosts(c *gin.Context) {
+	self.Library.Lock()
+	defer self.Library.Unlock()
+	hosts := map[string]bool{}
+	for hostname, _ := range self.Service.MemberList() {
+		hosts[hostname] = true
+	}
+	for _, project := range self.Library.Projects {
+		for hostname, _ := range project.Checkouts {
+			hosts[hostname] = true
+		}
+	}
+	list := []string{}
+	for hostname, _ := range hosts {
+		list = append(list, hostname)
+	}
+	sort.Strings(list)
+	c.JSON(http.StatusOK, gin.H{"hosts": list})
+}
+
+func (self *Server) GET_Host(c *gin.Context) {
+
+	hostname := c.Param("hostname")
+
+	self.Library.Lock()
+	defer self.Library.Unlock()
+
+	res := HostResource{
+		Hostname:  hostname,
+		AFK:       -1,
+		Checkouts: map[string]HostCheckout{},
+	}
+	res.URL, res.Member = self.Service.Member(hostname)
+	res.Version = self.Service.MemberRecord(hostname)["version"]
+	rtt, awolSince, awol := self.Health(hostname)
+	res.RTT = rtt
+	if awol {
+		res.AWOL = awolSince.Unix()
+	}
+
+	self.AFK.Lock()
+	if afk, hasKey := self.AFK.Map[hostname]; hasKey {
+		res.AFK = afk
+	}
+	self.AFK.Unlock()
+
+	for uuid, project := range self.Library.Projects {
+		if chk, hasKey := project.Checkouts[hostname]; hasKey {
+			res.Checkouts[uuid] = HostCheckout{project.Name, *chk}
+		}
+	}
+
+	if !res.Member && len(res.Checkouts) == 0 {
+		JSONError(c, http.StatusNotFound, "Unknown host: "+hostname)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HEADER_TIMESTAMP = "X-FCPXM-Timestamp"
+	HEADER_NONCE     = "X-FCPXM-Nonce"
+	HEADER_SIGNATURE = "X-FCPXM-Signature"
+	HEADER_CHALLENGE = "X-FCPXM-Challenge"
+	HEADER_PROOF     = "X-FCPXM-Proof"
+
+	AUTH_MAX_SKEW = 30 * time.Second
+)
+
+// Shared team secret, auth is disabled when empty
+var teamSecret = []byte{}
+
+var seenNonces = NonceCache{Seen: map[string]time.Time{}}
+
+// NonceCache remembers every nonce inside the skew window to reject replays
+type NonceCache struct {
+	sync.Mutex
+	Seen map[string]time.Time
+}
+
+// Use returns false if the nonce was already used
+func (self *NonceCache) Use(nonce string, now time.Time) bool {
+	self.Lock()
+	defer self.Unlock()
+	for n, t := range self.Seen {
+		if now.Sub(t) > 2*AUTH_MAX_SKEW {
+			delete(self.Seen, n)
+		}
+	}
+	if _, hasKey := self.Seen[nonce]; hasKey {
+		return false
+	}
+	self.Seen[nonce] = now
+	return true
+}
+
+func NewNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func hmacHex(secret []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range parts {
+		mac.Write([]byte(part))
+		mac.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func Signature(secret []byte, method, uri, timestamp, nonce string, body []byte) string {
+	digest := sha256.Sum256(body)
+	return hmacHex(secret, method, uri, timestamp, nonce, hex.EncodeToString(digest[:]))
+}
+
+// SignRequest adds the signature headers, body is what the request will send
+func SignRequest(req *http.Request, body []byte) {
+	if len(teamSecret) == 0 {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := NewNonce()
+	req.Header.Set(HEADER_TIMESTAMP, timestamp)
+	req.Header.Set(HEADER_NONCE, nonce)
+	req.Header.Set(HEADER_SIGNATURE, Signature(teamSecret, req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+}
+
+func VerifyRequest(req *http.Request, body []byte, now time.Time) error {
+	timestamp := req.Header.Get(HEADER_TIMESTAMP)
+	nonce := req.Header.Get(HEADER_NONCE)
+	signature := req.Header.Get(HEADER_SIGNATURE)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return errors.New("Missing signature")
+	}
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("Invalid timestamp: " + timestamp)
+	}
+	skew := now.Sub(time.Unix(t, 0))
+	if skew > AUTH_MAX_SKEW || skew < -AUTH_MAX_SKEW {
+		return errors.New(fmt.Sprintf("Timestamp outside of %s window", AUTH_MAX_SKEW))
+	}
+	expected := Signature(teamSecret, req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("Invalid signature")
+	}
+	if !seenNonces.Use(nonce, now) {
+		return errors.New("Replayed request")
+	}
+	return nil
+}
+
+// Signed guards routes that only other nodes (or scripts holding the secret) may call
+func Signed(c *gin.Context) {
+	if len(teamSecret) == 0 {
+		return
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		JSONError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	err = VerifyRequest(c.Request, body, time.Now())
+	if err != nil {
+		LogWarning(fmt.Sprintf("[AUTH] [%s] %s %s: %s", c.ClientIP(), c.Request.Method, c.Request.URL.Path, err.Error()))
+		JSONError(c, http.StatusUnauthorized, err.Error())
+	}
+}
+
+// Proof answers a discovery challenge, only a holder of the secret can compute it.
+// It is bound to the hostname and port the responder advertises over mDNS, so a
+// rogue peer can't relay our challenge to a real node and pass its answer off.
+func Proof(challenge, hostname string, port int) string {
+	return hmacHex(teamSecret, "pong", challenge, hostname, strconv.Itoa(port))
+}
+
+// NewSignedRequest is http.NewRequest with the signature headers set
+func NewSignedRequest(method, url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	SignRequest(req, body)
+	return req, nil
+}
@@ -30,15 +30,21 @@ func NewClient(service Service) Client {
 	cl.Service = service
 	cl.Library = FCPLibraries{}
 	cl.LibsChan = make(chan FCPLibraries)
-	cl.UpdateChan = make(chan FCPLibrary)
+	cl.UpdateChan = make(chan ProjectUpdate)
+	cl.State = NewClientState()
+	cl.Deliverables = NewDeliverableWatch()
 	return cl
 }
 
 type Client struct {
 	Host
-	Library    FCPLibraries
-	LibsChan   chan FCPLibraries
-	UpdateChan chan FCPLibrary
+	Library      FCPLibraries
+	LibsChan     chan FCPLibraries
+	UpdateChan   chan ProjectUpdate
+	Notifier     string
+	WatchPaths   []string
+	State        *ClientState // See GET /status
+	Deliverables *DeliverableWatch
 }
 
 func (self *Client) Start() error {
@@ -46,15 +52,16 @@ func (self *Client) Start() error {
 	usr, _ := user.Current()
 
 	go WatcherOpenLibraries(self.LibsChan, time.Tick(10*time.Second), self.Ctx)
-	fsPathsToWatch := []string{
+	self.WatchPaths = []string{
 		usr.HomeDir,
 		"/Volumes",
 	}
-	go WatcherPath(fsPathsToWatch, self.UpdateChan, self.Ctx)
+	go WatcherPath(self.WatchPaths, self.UpdateChan, self.Ctx)
 
 	go func(ctx context.Context) {
 		ticker_6 := time.Tick(6 * time.Minute)
-		ticker_15 := time.Tick(15 * time.Minute)
+		ticker_1 := time.Tick(1 * time.Minute)
+		ticker_5 := time.Tick(5 * time.Minute)
 	mLoop:
 		for {
 			select {
@@ -63,29 +70,35 @@ func (self *Client) Start() error {
 			case <-self.Service.BroadcastChan:
 				// Every time there are add/drops to the services list e.g. servers
 				self.ReportCheckouts()
+				self.FetchInbox()
 			case libs := <-self.LibsChan:
+				// Every scan, exports settle between scans that look the same
+				self.ReportDeliverables(libs)
 				// Every time a library is opened/closed
 				if !self.isSame(libs) {
 					self.Library = libs
 					self.ReportCheckouts()
 				}
-			case lib := <-self.UpdateChan:
+			case update := <-self.UpdateChan:
 				// Every time something changes inside a library
-				_, hasKey := self.Library[lib.UUID]
+				lib, hasKey := self.Library[update.UUID]
 				if hasKey {
-					self.UpdateProjectActivity(ProjectUpdate{
-						Hostname: self.Hostname,
-						UUID:     lib.UUID,
-						Last:     lib.Last,
-					})
+					storageCache.Invalidate(lib.Path, update.Event)
+					update.Hostname = self.Hostname
+					update.Source = UpdateSource(update.Kind, LastUSBActivity())
+					self.UpdateProjectActivity(update)
 				}
-			case <-ticker_15:
-				// Every 15 minutes
+			case <-ticker_1:
+				// Every minute, the server derives presence from these
 				self.SendAFK(LastUSBActivity())
+			case <-ticker_5:
+				// Every 5 minutes, only servers measured RTT before GET /status
+				self.CheckMembersAlive()
 			case <-ticker_6:
 				// Every 6 minutes
 				self.ReportCheckouts()
 			}
+			self.State.SetMembers(&self.Host)
 		}
 		LogWarning("[STOP] Client services")
 	}(self.Ctx)
@@ -106,10 +119,10 @@ func (self *Client) Listen() (err error) {
 		return errors.New("[client.Server] alerter not found: " + alerter)
 	}
 
-	notifier := filepath.Join(APP_BUNDLE, "notifier")
-	_, err = os.Stat(notifier)
+	self.Notifier = filepath.Join(APP_BUNDLE, "notifier")
+	_, err = os.Stat(self.Notifier)
 	if err != nil {
-		return errors.New("[client.Server] notifier not found: " + notifier)
+		return errors.New("[client.Server] notifier not found: " + self.Notifier)
 	}
 
 	r := self.Router
@@ -118,22 +131,19 @@ func (self *Client) Listen() (err error) {
 		c.JSON(200, gin.H{"ok": self.Hostname})
 	})
 
-	r.POST("/notify", func(c *gin.Context) {
+	r.GET("/metrics", self.GET_Metrics)
+
+	r.GET("/status", self.GET_Status)
+
+	r.POST("/notify", Signed, func(c *gin.Context) {
 		m := &NotifyMessage{}
 		json.NewDecoder(c.Request.Body).Decode(m)
-		noti := exec.Command(notifier,
-			"-title", "TTWP Notification",
-			"-sender", "com.ttwp.FCPXMonitor",
-			"-actions", "OK",
-			"-group", "1234",
-			"-message", m.Message,
-		)
-		noti.Start()
+		self.ShowNotification(m.Message)
 		c.JSON(200, gin.H{"notify": m.Message})
 	})
 
 	// This doesn't really work. Alerts don't come to front.
-	r.POST("/alert", func(c *gin.Context) {
+	r.POST("/alert", Signed, func(c *gin.Context) {
 		m := &NotifyMessage{}
 		json.NewDecoder(c.Request.Body).Decode(m)
 		go exec.Command(alerter, m.Message).Run()
@@ -142,7 +152,7 @@ func (self *Client) Listen() (err error) {
 
 	log.Printf("😎 client started: %s :%d [%s]", self.Hostname, self.Port, self.Service.TXTRecord["version"])
 
-	go r.Run(fmt.Sprintf(":%d", self.Port))
+	go self.Run()
 
 	<-self.Ctx.Done()
 
@@ -150,12 +160,43 @@ func (self *Client) Listen() (err error) {
 
 }
 
+func (self *Client) ShowNotification(message string) {
+	noti := exec.Command(self.Notifier,
+		"-title", "TTWP Notification",
+		"-sender", "com.ttwp.FCPXMonitor",
+		"-actions", "OK",
+		"-group", "1234",
+		"-message", message,
+	)
+	noti.Start()
+}
+
 func (self *Client) ReportCheckouts() {
 	clientPayload := self.toJSON()
-	self.Broadcast("_checkout", clientPayload, CBTODO)
+	self.Broadcast("_checkout", clientPayload, self.HandleCheckoutResponse)
+}
+
+func (self *Client) HandleCheckoutResponse(server string, body []byte) {
+	res := CheckoutResponse{}
+	err := json.Unmarshal(body, &res)
+	if err != nil {
+		LogError(fmt.Sprintf("[%s] %s", server, err.Error()))
+		return
+	}
+	self.State.SetResponse(server, res)
+	for _, uuid := range res.Errors {
+		LogWarning(fmt.Sprintf("[%s] [CONFLICT] %s", server, uuid))
+	}
+	for _, rejection := range res.Rejected {
+		LogWarning(fmt.Sprintf("[%s] [%d] %s", server, rejection.Status, rejection.Error))
+	}
 }
 
 func (self *Client) SendAFK(afk int64) {
+	if afk < 0 {
+		// ioreg failed, don't report the host as active
+		return
+	}
 	route := fmt.Sprintf("_afk/%s/%s", self.Hostname, strconv.FormatInt(afk, 10))
 	self.Broadcast(route, NOBODY, CBTODO)
 }
@@ -181,7 +222,23 @@ func (self *Client) isSame(libs FCPLibraries) bool {
 	if len(self.Library) != len(libs) {
 		return false
 	}
-	b1, _ := json.Marshal(self.Library)
-	b2, _ := json.Marshal(libs)
+	b1, _ := json.Marshal(withoutScanTimes(self.Library))
+	b2, _ := json.Marshal(withoutScanTimes(libs))
 	return string(b1) == string(b2)
 }
+
+// withoutScanTimes copies libs without the time of their storage scan, every rescan
+// changes it and only what the scan found is worth reporting
+func withoutScanTimes(libs FCPLibraries) FCPLibraries {
+	copied := FCPLibraries{}
+	for uuid, lib := range libs {
+		l := *lib
+		if l.Storage != nil {
+			storage := *l.Storage
+			storage.Scanned = 0
+			l.Storage = &storage
+		}
+		copied[uuid] = &l
+	}
+	return copied
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -40,9 +41,11 @@ type Host struct {
 	Service       Service
 	AWOL          map[string]time.Time
 	ResponseTimes map[string]float64
+	HealthLock    sync.Mutex // Guards AWOL and ResponseTimes, deliveries run concurrently
 	Ctx           context.Context
 	Shutdown      context.CancelFunc
 	Root          string
+	DataDir       string
 	Router        *gin.Engine
 }
 
@@ -52,6 +55,7 @@ func (self *Host) Init() {
 
 	runDir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
 	self.Root = filepath.Join(runDir, "dist_server")
+	self.DataDir = runDir
 
 	ctx, shutdown := context.WithCancel(context.Background())
 
@@ -68,7 +72,13 @@ func (self *Host) Init() {
 		c.Header("Access-Control-Request-Method", "GET")
 	})
 
+	r.Use(RequireTLS)
+
 	r.HEAD("/_ping", func(c *gin.Context) {
+		challenge := c.GetHeader(HEADER_CHALLENGE)
+		if challenge != "" && len(teamSecret) > 0 {
+			c.Header(HEADER_PROOF, Proof(challenge, self.Service.Hostname, self.Service.Port))
+		}
 		c.String(200, "pong")
 	})
 
@@ -77,7 +87,11 @@ func (self *Host) Init() {
 		c.Data(200, "application/json", b)
 	})
 
-	r.GET("/_shutdown", func(c *gin.Context) {
+	r.NoRoute(func(c *gin.Context) {
+		JSONError(c, http.StatusNotFound, "No such route: "+c.Request.URL.Path)
+	})
+
+	r.GET("/_shutdown", Signed, func(c *gin.Context) {
 		shutdown()
 		c.JSON(200, gin.H{"ok": "shutdown"})
 	})
@@ -87,9 +101,13 @@ func (self *Host) Init() {
 }
 
 func (self *Host) HandleError(err error, otherHost string) {
+	self.HealthLock.Lock()
 	lastSeen, wasAWOL := self.AWOL[otherHost]
 	if !wasAWOL {
 		self.AWOL[otherHost] = time.Now()
+	}
+	self.HealthLock.Unlock()
+	if !wasAWOL {
 		log.Printf("🏃💨 [%s]", otherHost)
 	} else if time.Since(lastSeen) > 60*time.Minute {
 		self.Remove(otherHost)
@@ -98,48 +116,148 @@ func (self *Host) HandleError(err error, otherHost string) {
 }
 
 func (self *Host) Remove(hostname string) {
-	delete(self.Service.Members, hostname)
+	self.Service.RemoveMember(hostname)
+	self.HealthLock.Lock()
+	defer self.HealthLock.Unlock()
 	delete(self.AWOL, hostname)
 	delete(self.ResponseTimes, hostname)
 }
 
+// Health is the last round trip time to a member and since when it's been unreachable, if it is
+func (self *Host) Health(hostname string) (rtt float64, awolSince time.Time, awol bool) {
+	self.HealthLock.Lock()
+	defer self.HealthLock.Unlock()
+	awolSince, awol = self.AWOL[hostname]
+	return self.ResponseTimes[hostname], awolSince, awol
+}
+
 func (self *Host) Broadcast(route string, body []byte, callback func(string, []byte)) {
 
 	/* Do NOT pass nil into this function, use `callback_todo` or `NOBODY` instead */
 
+	for hostname, url := range self.Service.MemberList() {
+		self.send(hostname, url, route, body, callback)
+	}
+
+}
+
+// Send is Broadcast to a single member
+func (self *Host) Send(hostname, route string, body []byte, callback func(string, []byte)) error {
+	url, hasKey := self.Service.Member(hostname)
+	if !hasKey {
+		return errors.New("Not a member: " + hostname)
+	}
+	self.send(hostname, url, route, body, callback)
+	return nil
+}
+
+const (
+	SEND_EACH_TIMEOUT = 8 * time.Second // Above the 5s of NewHTTPTimeoutClient
+
+	DELIVERED   = "delivered"
+	HTTP_ERROR  = "http_error"
+	UNREACHABLE = "unreachable"
+)
+
+// Delivery is the outcome of one request to one member
+type Delivery struct {
+	Status string `json:"status"` // DELIVERED, HTTP_ERROR or UNREACHABLE
+	Code   int    `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+	body   []byte
+}
+
+func (self *Host) send(hostname, url, route string, body []byte, callback func(string, []byte)) {
+	d := self.deliver(hostname, url, route, body)
+	if d.Status == DELIVERED && callback != nil {
+		go callback(hostname, d.body)
+	}
+}
+
+func (self *Host) deliver(hostname, url, route string, body []byte) Delivery {
+
 	var res *http.Response
 	var err error
 
-	for hostname, url := range self.Service.Members {
+	c := NewNodeClient(hostname)
+	url = fmt.Sprintf("%s/%s", url, route)
 
-		c := NewHTTPTimeoutClient()
-		url := fmt.Sprintf("%s/%s", url, route)
-
-		if len(body) > 0 {
-			res, err = c.Post(url, "application/json", bytes.NewReader(body))
-		} else {
-			res, err = c.Get(url)
-		}
+	method := "GET"
+	if len(body) > 0 {
+		method = "POST"
+	}
 
-		if err != nil {
-			self.HandleError(err, hostname)
-			continue
-		}
+	req, err := NewSignedRequest(method, url, body)
+	if err == nil {
+		res, err = c.Do(req)
+	}
 
-		delete(self.AWOL, hostname)
-		defer res.Body.Close()
-		b, _ := ioutil.ReadAll(res.Body)
-		msg := fmt.Sprintf("[%s][%d][%s] %s", hostname, res.StatusCode, route, string(b))
-		if res.StatusCode != http.StatusOK {
-			msg = "⚠️ " + msg
-		} else if callback != nil {
-			go callback(hostname, b)
-		}
+	if err != nil {
+		metrics.Inc(METRIC_BROADCAST, "route", metricRoute(route), "result", UNREACHABLE)
+		self.HandleError(err, hostname)
+		return Delivery{Status: UNREACHABLE, Error: err.Error()}
+	}
 
+	self.HealthLock.Lock()
+	delete(self.AWOL, hostname)
+	self.HealthLock.Unlock()
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		metrics.Inc(METRIC_BROADCAST, "route", metricRoute(route), "result", HTTP_ERROR)
+		LogWarning(fmt.Sprintf("[%s][%d][%s] %s", hostname, res.StatusCode, route, string(b)))
+		return Delivery{Status: HTTP_ERROR, Code: res.StatusCode, Error: string(b), body: b}
 	}
+	metrics.Inc(METRIC_BROADCAST, "route", metricRoute(route), "result", DELIVERED)
+	return Delivery{Status: DELIVERED, Code: res.StatusCode, body: b}
 
 }
 
+// SendEach is Broadcast to some members, reporting how each delivery went. Members
+// are sent to concurrently and the whole call takes at most SEND_EACH_TIMEOUT.
+func (self *Host) SendEach(hostnames []string, route string, body []byte) map[string]Delivery {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	results := map[string]Delivery{}
+	urls := map[string]string{}
+	for _, hostname := range hostnames {
+		url, hasKey := self.Service.Member(hostname)
+		if !hasKey {
+			results[hostname] = Delivery{Status: UNREACHABLE, Error: "Not a member: " + hostname}
+			continue
+		}
+		results[hostname] = Delivery{Status: UNREACHABLE, Error: "Timed out"}
+		urls[hostname] = url
+	}
+	for hostname, url := range urls {
+		wg.Add(1)
+		go func(hostname, url string) {
+			defer wg.Done()
+			d := self.deliver(hostname, url, route, body)
+			lock.Lock()
+			defer lock.Unlock()
+			results[hostname] = d
+		}(hostname, url)
+	}
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(SEND_EACH_TIMEOUT):
+	}
+	// Late deliveries still write to `results`
+	lock.Lock()
+	defer lock.Unlock()
+	copied := map[string]Delivery{}
+	for hostname, d := range results {
+		copied[hostname] = d
+	}
+	return copied
+}
+
 func Lag(t time.Time) float64 {
 	lagNano := time.Now().Sub(t).Nanoseconds()
 	return float64(lagNano) / 1000000.0
@@ -149,8 +267,11 @@ func (self *Host) CheckMembersAlive() {
 	self.Broadcast("_pong", NOBODY, func(hostname string, body []byte) {
 		t := T{}
 		json.Unmarshal(body, &t)
-		self.ResponseTimes[hostname] = Lag(t.T)
-		log.Printf("⏱️ [%s] %.2f ms\n", hostname, self.ResponseTimes[hostname])
+		rtt := Lag(t.T)
+		self.HealthLock.Lock()
+		self.ResponseTimes[hostname] = rtt
+		self.HealthLock.Unlock()
+		log.Printf("⏱️ [%s] %.2f ms\n", hostname, rtt)
 	})
 }
 
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EVENT_RESOLVED = "resolved"
+)
+
+type Conflict struct {
+	UUID  string   `json:"uuid"`
+	Name  string   `json:"name"`
+	Hosts []string `json:"hosts"`
+}
+
+func (self Conflict) Key() string {
+	return strings.Join(self.Hosts, "|")
+}
+
+// Others returns every host in the conflict except `host`
+func (self Conflict) Others(host string) []string {
+	others := []string{}
+	for _, h := range self.Hosts {
+		if h != host {
+			others = append(others, h)
+		}
+	}
+	return others
+}
+
+// Conflicts returns every project checked out by more than one host
+func (self *Library) Conflicts() map[string]Conflict {
+	conflicts := map[string]Conflict{}
+	for uuid, project := range self.Projects {
+		if len(project.Checkouts) < 2 {
+			continue
+		}
+		hosts := []string{}
+		for host, _ := range project.Checkouts {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		conflicts[uuid] = Conflict{
+			UUID:  uuid,
+			Name:  project.Name,
+			Hosts: hosts,
+		}
+	}
+	return conflicts
+}
+
+// ReconcileConflicts compares the library's conflicts against the ones we already
+// told everyone about. Hosts are only notified when a conflict starts, when the
+// hosts involved change and when it clears. The caller must hold the library lock.
+func (self *Server) ReconcileConflicts() {
+
+	current := self.Library.Conflicts()
+
+	for uuid, conflict := range current {
+		previous, hasKey := self.Conflicts[uuid]
+		if hasKey && previous.Key() == conflict.Key() {
+			continue
+		}
+		log.Printf("💥 [%s] %s open on %s", uuid, conflict.Name, strings.Join(conflict.Hosts, ", "))
+		// Recorded per host by Checkout
+		for _, host := range conflict.Hosts {
+			msg := fmt.Sprintf("⚠️ '%s' is also open on %s", conflict.Name, strings.Join(conflict.Others(host), ", "))
+			go self.Notify(host, msg)
+		}
+	}
+
+	for uuid, previous := range self.Conflicts {
+		_, hasKey := current[uuid]
+		if hasKey {
+			continue
+		}
+		log.Printf("🤝 [%s] %s conflict resolved", uuid, previous.Name)
+		self.Record(EVENT_RESOLVED, uuid, previous.Name, "", previous.Key())
+		for _, host := range previous.Hosts {
+			if !self.Library.HasCheckout(uuid, host) {
+				continue
+			}
+			msg := fmt.Sprintf("✅ '%s' is no longer open on %s", previous.Name, strings.Join(previous.Others(host), ", "))
+			go self.Notify(host, msg)
+		}
+	}
+
+	self.Conflicts = current
+
+}
+
+func (self *Server) GET_Conflicts(c *gin.Context) {
+	self.Library.Lock()
+	defer self.Library.Unlock()
+	c.JSON(http.StatusOK, gin.H{"conflicts": self.Conflicts})
+}
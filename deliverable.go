@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EVENT_VERSION = "version"
+
+	// Replacing the same file again within this is one replacement, e.g. re-exporting after a typo
+	DELIVERABLE_COLLAPSE = 10 * time.Minute
+)
+
+type DeliverableUpdate struct {
+	Hostname    string      `json:"hostname"`
+	UUID        string      `json:"uuid"`
+	Name        string      `json:"name"` // Library name
+	Deliverable Deliverable `json:"deliverable"`
+	Replaced    bool        `json:"replaced"` // An existing file was rendered over
+}
+
+type VersionEvent struct {
+	Deliverable
+	Hostname string `json:"hostname"`
+	Replaced bool   `json:"replaced"`
+	T        int64  `json:"t"`
+}
+
+func NewDeliverableWatch() *DeliverableWatch {
+	return &DeliverableWatch{
+		Known:   map[string]map[string]Deliverable{},
+		Pending: map[string]map[string]Deliverable{},
+	}
+}
+
+// DeliverableWatch follows the outputs of open libraries between scans. A file is
+// only reported once its size and mtime held for a whole scan, so an export in
+// progress isn't reported on every scan while it grows.
+type DeliverableWatch struct {
+	Known   map[string]map[string]Deliverable // uuid -> folder/name, as last reported
+	Pending map[string]map[string]Deliverable // uuid -> folder/name, changed and waiting to settle
+}
+
+func sameFile(a, b Deliverable) bool {
+	return a.Size == b.Size && a.Mtime == b.Mtime
+}
+
+// Scan returns the files that are new or were replaced, and settled, in the outputs
+// of libraries that were already open at the previous scan
+func (self *DeliverableWatch) Scan(libs FCPLibraries) []DeliverableUpdate {
+	updates := []DeliverableUpdate{}
+	for uuid, _ := range self.Known {
+		if _, isOpen := libs[uuid]; !isOpen {
+			delete(self.Known, uuid)
+			delete(self.Pending, uuid)
+		}
+	}
+	for uuid, lib := range libs {
+		known, wasOpen := self.Known[uuid]
+		if !wasOpen {
+			// What's there when the library is opened is old news
+			known = map[string]Deliverable{}
+			for _, d := range lib.Versions {
+				known[d.Folder+"/"+d.Name] = d
+			}
+			self.Known[uuid] = known
+			self.Pending[uuid] = map[string]Deliverable{}
+			continue
+		}
+		pending := self.Pending[uuid]
+		current := map[string]bool{}
+		for _, d := range lib.Versions {
+			key := d.Folder + "/" + d.Name
+			current[key] = true
+			old, isKnown := known[key]
+			if isKnown && sameFile(old, d) {
+				delete(pending, key)
+				continue
+			}
+			last, isPending := pending[key]
+			if !isPending || !sameFile(last, d) {
+				pending[key] = d
+				continue
+			}
+			delete(pending, key)
+			known[key] = d
+			updates = append(updates, DeliverableUpdate{
+				UUID:        uuid,
+				Name:        lib.Name,
+				Deliverable: d,
+				Replaced:    isKnown,
+			})
+		}
+		for key, _ := range pending {
+			if !current[key] {
+				delete(pending, key)
+			}
+		}
+	}
+	return updates
+}
+
+// AddVersion appends to a project's version timeline. Returns false if this exact
+// file was already recorded, or if it replaces a file replaced less than
+// DELIVERABLE_COLLAPSE ago, in which case that entry is updated instead.
+func (self *Library) AddVersion(update DeliverableUpdate) bool {
+	d := update.Deliverable
+	now := time.Now().Unix()
+	timeline := self.Timelines[update.UUID]
+	for _, v := range timeline {
+		if v.Folder == d.Folder && v.Name == d.Name && v.Size == d.Size && v.Mtime == d.Mtime {
+			return false
+		}
+	}
+	if update.Replaced {
+		for i := len(timeline) - 1; i >= 0; i-- {
+			v := &timeline[i]
+			if v.Folder != d.Folder || v.Name != d.Name {
+				continue
+			}
+			if v.Replaced && now-v.T < int64(DELIVERABLE_COLLAPSE.Seconds()) {
+				v.Deliverable = d
+				v.Hostname = update.Hostname
+				return false
+			}
+			break
+		}
+	}
+	self.Timelines[update.UUID] = append(timeline, VersionEvent{
+		Deliverable: d,
+		Hostname:    update.Hostname,
+		Replaced:    update.Replaced,
+		T:           now,
+	})
+	return true
+}
+
+func (self *Library) Subscribe(uuid, hostname string) {
+	self.Touch(STAMP_SUBSCRIPTION, uuid, hostname, false)
+	for _, h := range self.Subscriptions[uuid] {
+		if h == hostname {
+			return
+		}
+	}
+	self.Subscriptions[uuid] = append(self.Subscriptions[uuid], hostname)
+	sort.Strings(self.Subscriptions[uuid])
+}
+
+func (self *Library) Unsubscribe(uuid, hostname string) {
+	self.Touch(STAMP_SUBSCRIPTION, uuid, hostname, true)
+	hosts := []string{}
+	for _, h := range self.Subscriptions[uuid] {
+		if h != hostname {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == 0 {
+		delete(self.Subscriptions, uuid)
+	} else {
+		self.Subscriptions[uuid] = hosts
+	}
+}
+
+// ReportDeliverables tells the servers about any new or replaced files in the outputs of libraries that were already open
+func (self *Client) ReportDeliverables(libs FCPLibraries) {
+	for _, update := range self.Deliverables.Scan(libs) {
+		update.Hostname = self.Hostname
+		body, _ := json.Marshal(update)
+		log.Printf("🎬 [%s] %s", update.Name, update.Deliverable.Name)
+		self.Broadcast("_deliverable", body, CBTODO)
+	}
+}
+
+func (self *Server) POST_Deliverable(c *gin.Context) {
+
+	update := DeliverableUpdate{}
+	err := json.NewDecoder(c.Request.Body).Decode(&update)
+	if err != nil {
+		LogError(err.Error())
+		JSONError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	self.Library.Lock()
+	defer self.Library.Unlock()
+
+	if !self.Library.AddVersion(update) {
+		if update.Replaced {
+			// Possibly collapsed into the previous replacement
+			self.SaveLibrary()
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": "known"})
+		return
+	}
+
+	self.SaveLibrary()
+
+	d := update.Deliverable
+	verb := "New version"
+	if update.Replaced {
+		verb = "Replaced version"
+	}
+	self.Record(EVENT_VERSION, update.UUID, update.Name, update.Hostname, d.Name)
+	log.Printf("🎬 [%s] [%s] %s", update.Hostname, update.UUID, d.Name)
+
+	msg := fmt.Sprintf("🎬 %s of '%s': %s (%s)", verb, update.Name, d.Name, update.Hostname)
+	for _, hostname := range self.Library.Subscriptions[update.UUID] {
+		go self.Notify(hostname, msg)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ok": d.Name})
+
+}
+
+func (self *Server) GET_Versions(c *gin.Context) {
+	self.Library.Lock()
+	defer self.Library.Unlock()
+	timeline, hasKey := self.Library.Timelines[c.Param("uuid")]
+	if !hasKey {
+		timeline = []VersionEvent{}
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": timeline})
+}
+
+func (self *Server) GET_Subscriptions(c *gin.Context) {
+	self.Library.Lock()
+	defer self.Library.Unlock()
+	c.JSON(http.StatusOK, gin.H{"subscriptions": self.Library.Subscriptions})
+}
+
+func (self *Server) POST_Subscription(c *gin.Context) {
+
+	sub := struct {
+		UUID     string `json:"uuid"`
+		Hostname string `json:"hostname"`
+	}{}
+	err := json.NewDecoder(c.Request.Body).Decode(&sub)
+	if err != nil || sub.UUID == "" || sub.Hostname == "" {
+		JSONError(c, http.StatusBadRequest, "Subscription needs a uuid and hostname")
+		return
+	}
+
+	self.Library.Lock()
+	defer self.Library.Unlock()
+
+	self.Library.Subscribe(sub.UUID, sub.Hostname)
+	self.SaveLibrary()
+
+	c.JSON(http.StatusOK, gin.H{"subscriptions": self.Library.Subscriptions[sub.UUID]})
+
+}
+
+func (self *Server) DELETE_Subscription(c *gin.Context) {
+
+	self.Library.Lock()
+	defer self.Library.Unlock()
+
+	self.Library.Unsubscribe(c.Param("uuid"), c.Param("hostname"))
+	self.SaveLibrary()
+
+	c.JSON(http.StatusOK, gin.H{"ok": c.Param("hostname")})
+
+}
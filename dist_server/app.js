@@ -2,6 +2,7 @@ import Library from "./library.js";
 
 Vue.prototype.$urls = {
 	library: "library",
+	events: "events",
 }
 
 Vue.filter("formatSince", function(value) {
@@ -19,6 +20,15 @@ Vue.filter("formatTime", function(value) {
   }
 });
 
+Vue.filter("formatBytes", function(value) {
+  if (!value) {
+    return "0 B";
+  }
+  let units = ["B", "KB", "MB", "GB", "TB"];
+  let i = Math.min(Math.floor(Math.log(value) / Math.log(1024)), units.length - 1);
+  return (value / Math.pow(1024, i)).toFixed(1) + " " + units[i];
+});
+
 Vue.filter("formatProjectTitle", function(value) {
   if (value) {
     return value.replace(/\.fcpbundle/,"");
@@ -32,24 +42,45 @@ const App = new Vue({
   methods: {
     log(line) {
       console.log(line);
+    },
+    refresh() {
+      let self = this
+      return fetch(self.$urls.library)
+        .then(function(response) {
+          return response.json()
+        })
+        .then(function(data) {
+          self.$set(self.lib, "library", data.library)
+        })
+    },
+    subscribe() {
+      let self = this
+      let pending = null
+      let source = new EventSource(self.$urls.events)
+      let onChange = function(e) {
+        // Coalesce bursts of events into a single refetch
+        if (pending) {
+          return
+        }
+        pending = setTimeout(function() {
+          pending = null
+          self.refresh()
+        }, 250)
+      }
+      for (let kind of ["checkout", "close", "remove", "update", "conflict", "resolved", "expired", "released", "reserve", "release", "version", "afk", "join", "leave"]) {
+        source.addEventListener(kind, onChange)
+      }
+      source.onopen = function() {
+        // Catch up on anything missed while disconnected
+        self.refresh()
+      }
     }
   },
 	async beforeMount () {
-		let response = await fetch(this.$urls.library)
-		let data = await response.json()
-		this.lib.library = data.library
+		await this.refresh()
 	},
 	created () {
-		let self = this
-		setInterval(function () {
-      		fetch(self.$urls.library)
-			.then(function(response) {
-				return response.json()
-			})
-			.then(function(data) {
-				self.$set(self.lib, "library", data.library)
-			})
-		}, 5000); 
+		this.subscribe()
 	},
   template: `
   <div id="app">
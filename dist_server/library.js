@@ -7,12 +7,33 @@ export default {
         <ul>
             <li class="pname inlineblock">{{ p.name | formatProjectTitle }}</li>
             <li class="puuid inlineblock">{{ k }}</li>
+            <li v-if="p.storage" class="pstorage rubik">
+                {{ p.storage.total | formatBytes }} ·
+                renders {{ p.storage.render_files | formatBytes }} ·
+                proxy {{ p.storage.proxy_media | formatBytes }} ·
+                optimized {{ p.storage.optimized_media | formatBytes }} ·
+                analysis {{ p.storage.analysis_files | formatBytes }} ·
+                media {{ p.storage.original_media | formatBytes }} ·
+                databases {{ p.storage.databases | formatBytes }}
+            </li>
+            <ul class="events" v-if="p.events && p.events.length">
+                <li v-for="ev in p.events" class="event rubik">
+                    <div class="inlineblock ename">{{ ev.name }}</div>
+                    <div class="inlineblock">{{ ev.project_count }} projects · {{ ev.clip_count }} clips</div>
+                    <div class="inlineblock">{{ ev.modified | formatTime }}</div>
+                    <div v-if="ev.projects.length" class="eprojects">{{ ev.projects.join(", ") }}</div>
+                    <div v-for="(act,host) in (p.activity || {})[ev.folder]" class="eactivity">
+                        {{ host }} · {{ act.kind }}<span v-if="act.source == 'background'"> (background)</span> · {{ act.last | formatSince }}
+                    </div>
+                </li>
+            </ul>
             <ul class="checkouts">
                 <li v-for="(details,host) in p.checkouts">
                     <ul class="checkout">
                         <li class="hostHeader">
                             <div class="chost inlineblock">{{ host }}</div>
                             <div class="clast inlineblock">{{ details.last | formatSince }}</div>
+                            <div v-if="details.unconfirmed" class="inlineblock rubik">(unconfirmed)</div>
                         </li>
                         <li class="cpath rubik">{{ details.path }}</li>
 			            <li v-if="p.info.version">
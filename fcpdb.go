@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"howett.net/plist"
+)
+
+const (
+	FCP_LIBRARY_DB = "CurrentVersion.flexolibrary"
+	FCP_EVENT_DB   = "CurrentVersion.fcpevent"
+	COCOA_EPOCH    = 978307200 // 2001-01-01 00:00:00 UTC
+)
+
+var (
+	// ZCOLLECTION.ZTYPE of the rows we care about
+	fcpEventRecordType = "FFEventRecord"
+	fcpEventType       = "FFMediaEventProject" // Legacy naming, this is the event itself
+	fcpProjectTypes    = map[string]bool{"FFAnchoredSequence": true, "FFProject": true}
+
+	eventCache = EventCache{Events: map[string]FCPEvent{}}
+)
+
+type FCPEvent struct {
+	Name         string   `json:"name"`
+	Folder       string   `json:"folder"`
+	Projects     []string `json:"projects"`
+	ProjectCount int      `json:"project_count"`
+	ClipCount    int      `json:"clip_count"`
+	Modified     int64    `json:"modified"`
+}
+
+// EventCache keeps parsed events keyed by database path and mtime, so we only
+// open a database after Final Cut has written to it.
+type EventCache struct {
+	sync.Mutex
+	Events map[string]FCPEvent
+}
+
+func (self *EventCache) Get(fp string) (FCPEvent, error) {
+	fifo, err := os.Stat(fp)
+	if err != nil {
+		return FCPEvent{}, err
+	}
+	key := fp + "@" + fifo.ModTime().String()
+	self.Lock()
+	ev, hasKey := self.Events[key]
+	self.Unlock()
+	if hasKey {
+		return ev, nil
+	}
+	ev, err = ReadEventDatabase(fp)
+	if err != nil {
+		return ev, err
+	}
+	if ev.Modified == 0 {
+		ev.Modified = fifo.ModTime().Unix()
+	}
+	self.Lock()
+	for k, _ := range self.Events {
+		if strings.HasPrefix(k, fp+"@") {
+			delete(self.Events, k)
+		}
+	}
+	self.Events[key] = ev
+	self.Unlock()
+	return ev, nil
+}
+
+func OpenFCPDatabase(fp string) (*sql.DB, error) {
+	_, err := os.Stat(fp)
+	if err != nil {
+		return nil, err
+	}
+	escape := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23")
+	return sql.Open("sqlite3", "file:"+escape.Replace(fp)+"?mode=ro")
+}
+
+type fcpCollection struct {
+	Type     string
+	Name     string
+	Metadata map[string]interface{}
+}
+
+func readCollections(fp string) ([]fcpCollection, error) {
+	collections := []fcpCollection{}
+	db, err := OpenFCPDatabase(fp)
+	if err != nil {
+		return collections, err
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT c.ZTYPE, c.ZNAME, m.ZDICTIONARYDATA FROM ZCOLLECTION c LEFT JOIN ZCOLLECTIONMD m ON m.Z_PK = c.ZMETADATA`)
+	if err != nil {
+		return collections, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ztype, zname sql.NullString
+		var data []byte
+		err = rows.Scan(&ztype, &zname, &data)
+		if err != nil {
+			return collections, err
+		}
+		col := fcpCollection{Type: ztype.String, Name: zname.String, Metadata: map[string]interface{}{}}
+		if len(data) > 0 {
+			md, err := Unarchive(data)
+			if err == nil {
+				col.Metadata = md
+			}
+		}
+		collections = append(collections, col)
+	}
+	return collections, rows.Err()
+}
+
+// ReadEventDatabase extracts an event's name, projects and modification time from its CurrentVersion.fcpevent
+func ReadEventDatabase(fp string) (FCPEvent, error) {
+	folder := filepath.Base(filepath.Dir(fp))
+	ev := FCPEvent{
+		Name:     folder,
+		Folder:   folder,
+		Projects: []string{},
+	}
+	collections, err := readCollections(fp)
+	if err != nil {
+		return ev, err
+	}
+	for _, col := range collections {
+		switch {
+		case col.Type == fcpEventType:
+			if name, ok := col.Metadata["displayName"].(string); ok && name != "" {
+				ev.Name = name
+			}
+			if t, ok := col.Metadata["modDate"].(time.Time); ok {
+				ev.Modified = t.Unix()
+			}
+			if info, ok := col.Metadata["eventInfo"].(map[string]interface{}); ok {
+				ev.ProjectCount = toInt(info["countOfProjects"])
+				ev.ClipCount = toInt(info["countOfClips"])
+			}
+		case fcpProjectTypes[col.Type]:
+			name, _ := col.Metadata["displayName"].(string)
+			if name == "" {
+				name, _ = col.Metadata["name"].(string)
+			}
+			if name == "" {
+				name = col.Name
+			}
+			ev.Projects = append(ev.Projects, name)
+		}
+	}
+	if len(ev.Projects) > ev.ProjectCount {
+		ev.ProjectCount = len(ev.Projects)
+	}
+	sort.Strings(ev.Projects)
+	return ev, nil
+}
+
+// EventFolders lists the event folders of a library, from the library database if
+// possible, otherwise every folder in the bundle that has an event database.
+func EventFolders(bundlePath string) []string {
+	folders := []string{}
+	collections, err := readCollections(filepath.Join(bundlePath, FCP_LIBRARY_DB))
+	if err == nil {
+		for _, col := range collections {
+			if col.Type != fcpEventRecordType {
+				continue
+			}
+			if folder, ok := col.Metadata["relativePath"].(string); ok && folder != "" {
+				folders = append(folders, folder)
+			}
+		}
+	}
+	if len(folders) > 0 {
+		sort.Strings(folders)
+		return folders
+	}
+	files, _ := ioutil.ReadDir(bundlePath)
+	for _, fifo := range files {
+		if !fifo.IsDir() {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(bundlePath, fifo.Name(), FCP_EVENT_DB))
+		if err == nil {
+			folders = append(folders, fifo.Name())
+		}
+	}
+	return folders
+}
+
+func ReadLibraryEvents(bundlePath string) ([]FCPEvent, error) {
+	events := []FCPEvent{}
+	errs := []string{}
+	for _, folder := range EventFolders(bundlePath) {
+		ev, err := eventCache.Get(filepath.Join(bundlePath, folder, FCP_EVENT_DB))
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		ev.Folder = folder
+		events = append(events, ev)
+	}
+	if len(errs) > 0 {
+		return events, errors.New(strings.Join(errs, " | "))
+	}
+	return events, nil
+}
+
+// Unarchive decodes an NSKeyedArchiver plist into plain maps, slices and values
+func Unarchive(b []byte) (map[string]interface{}, error) {
+	archive := struct {
+		Objects []interface{}          `plist:"$objects"`
+		Top     map[string]interface{} `plist:"$top"`
+	}{}
+	_, err := plist.Unmarshal(b, &archive)
+	if err != nil {
+		return nil, err
+	}
+	root, hasKey := archive.Top["root"]
+	if !hasKey {
+		return nil, errors.New("No root object in archive")
+	}
+	m, ok := resolveArchived(archive.Objects, root, 0).(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Archive root is not a dictionary")
+	}
+	return m, nil
+}
+
+func resolveArchived(objects []interface{}, v interface{}, depth int) interface{} {
+	if depth > 16 {
+		return nil
+	}
+	if uid, ok := v.(plist.UID); ok {
+		if int(uid) >= len(objects) {
+			return nil
+		}
+		v = objects[uid]
+	}
+	switch obj := v.(type) {
+	case string:
+		if obj == "$null" {
+			return nil
+		}
+		return obj
+	case map[string]interface{}:
+		if keys, ok := obj["NS.keys"].([]interface{}); ok {
+			values, _ := obj["NS.objects"].([]interface{})
+			m := map[string]interface{}{}
+			for i, k := range keys {
+				key, ok := resolveArchived(objects, k, depth+1).(string)
+				if ok && i < len(values) {
+					m[key] = resolveArchived(objects, values[i], depth+1)
+				}
+			}
+			return m
+		}
+		if values, ok := obj["NS.objects"].([]interface{}); ok {
+			list := []interface{}{}
+			for _, value := range values {
+				list = append(list, resolveArchived(objects, value, depth+1))
+			}
+			return list
+		}
+		if t, ok := obj["NS.time"].(float64); ok {
+			return time.Unix(COCOA_EPOCH+int64(t), 0)
+		}
+		m := map[string]interface{}{}
+		for k, value := range obj {
+			if k != "$class" {
+				m[k] = resolveArchived(objects, value, depth+1)
+			}
+		}
+		return m
+	}
+	return v
+}
+
+func toInt(v interface{}) int {
+	switch i := v.(type) {
+	case uint64:
+		return int(i)
+	case int64:
+		return int(i)
+	case int:
+		return i
+	case float64:
+		return int(i)
+	}
+	return 0
+}
@@ -3,10 +3,8 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os/exec"
 	"path"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -15,21 +13,50 @@ import (
 )
 
 var (
-	re_outputs  = regexp.MustCompile(`(?i)^outputs?$`)
-	re_versions = regexp.MustCompile(`(?i)[ _-]v(\d+)[a-z]?[. _-].*(mov|mp4|m4v)`)
+	re_versions = regexp.MustCompile(`(?i)[ _-]v(?P<number>\d+)(?P<revision>[a-z]?)[. _-].*(mov|mp4|m4v)`)
 )
 
 type FCPLibrary struct {
-	Name string            `json:"name"`
-	Path string            `json:"path"`
-	UUID string            `json:"uuid"`
-	Info map[string]string `json:"info"`
-	Last int64             `json:"last"`
+	Name     string            `json:"name"`
+	Path     string            `json:"path"`
+	UUID     string            `json:"uuid"`
+	Info     map[string]string `json:"info"`
+	Last     int64             `json:"last"`
+	Events   []FCPEvent        `json:"events"`
+	Storage  *BundleStorage    `json:"storage,omitempty"`
+	Versions []Deliverable     `json:"versions"`
 }
 
 var (
-	re_fcpbundle   = regexp.MustCompile(`^(.+\.fcpbundle)\/.*CurrentVersion.fcpevent.*`)
-	re_bundle_uuid = regexp.MustCompile(`\w{8}-\w{4}-\w{4}-\w{4}-\w{12}`)
+	re_fcpbundle      = regexp.MustCompile(`^(.+\.fcpbundle)\/.*CurrentVersion.fcpevent.*`)
+	re_fcpbundle_file = regexp.MustCompile(`^(.+?\.fcpbundle)\/(.+)$`)
+	re_bundle_uuid    = regexp.MustCompile(`\w{8}-\w{4}-\w{4}-\w{4}-\w{12}`)
+)
+
+// What kind of file changed inside a bundle
+const (
+	CHANGE_LIBRARY_DB = "library_db"
+	CHANGE_EVENT_DB   = "event_db"
+	CHANGE_RENDER     = "render"
+	CHANGE_TRANSCODE  = "transcode"
+	CHANGE_ANALYSIS   = "analysis"
+	CHANGE_MEDIA      = "media"
+	CHANGE_OTHER      = "other"
+)
+
+// Who caused a change, see UpdateSource
+const (
+	SOURCE_USER       = "user"
+	SOURCE_BACKGROUND = "background"
+)
+
+var (
+	changeFolders = map[string]string{
+		"Render Files":     CHANGE_RENDER,
+		"Transcoded Media": CHANGE_TRANSCODE,
+		"Analysis Files":   CHANGE_ANALYSIS,
+		"Original Media":   CHANGE_MEDIA,
+	}
 )
 
 func NewFCPProject(bundlePath string) (lib FCPLibrary, err error) {
@@ -42,60 +69,29 @@ func NewFCPProject(bundlePath string) (lib FCPLibrary, err error) {
 		Info: map[string]string{},
 	}
 	lib.UUID, err = GetLibraryUUID(lib.Path)
-	version_mtime := FindLatestVersion(bundlePath)
-	if version_mtime[0] != "" {
-		lib.Info["version"] = version_mtime[0]
-		lib.Info["version_mtime"] = version_mtime[1]
+	lib.Versions = FindVersions(bundlePath)
+	if len(lib.Versions) > 0 {
+		latest := lib.Versions[len(lib.Versions)-1]
+		lib.Info["version"] = latest.Name
+		lib.Info["version_mtime"] = strconv.FormatInt(latest.Mtime, 10)
 	}
 	return lib, err
 }
 
+// GetLatestVersionName returns the highest version among `filenames`
 func GetLatestVersionName(filenames []string) (highest string) {
-	version := 0
+	versions := []Deliverable{}
 	for _, fn := range filenames {
-		m := re_versions.FindAllStringSubmatch(fn, -1)
-		if len(m) > 0 {
-			i, err := strconv.Atoi(m[0][1])
-			if err == nil {
-				if i > version {
-					version = i
-					highest = fn
-				}
-			}
+		d, ok := versionRules.Parse(fn)
+		if ok {
+			versions = append(versions, d)
 		}
 	}
-	return highest
-}
-
-func FindLatestVersion(bundlePath string) [2]string {
-
-	version_mtime := [2]string{}
-	versions := []string{}
-	mtimes := map[string]string{}
-
-	parent, _ := filepath.Split(bundlePath)
-	files, _ := ioutil.ReadDir(parent)
-
-	for _, fifo := range files {
-		if fifo.IsDir() && re_outputs.MatchString(fifo.Name()) {
-			outputs_folder := filepath.Join(parent, fifo.Name())
-			files, _ := ioutil.ReadDir(outputs_folder)
-			for _, fifo := range files {
-				if !fifo.IsDir() && re_versions.MatchString(fifo.Name()) {
-					versions = append(versions, fifo.Name())
-					mtimes[fifo.Name()] = strconv.FormatInt(fifo.ModTime().Unix(), 10)
-				}
-			}
-			if len(versions) > 0 {
-				fn := GetLatestVersionName(versions)
-				version_mtime[0] = fn
-				version_mtime[1] = mtimes[fn]
-				return version_mtime
-			}
-			break
-		}
+	if len(versions) == 0 {
+		return highest
 	}
-	return version_mtime
+	SortDeliverables(versions)
+	return versions[len(versions)-1].Name
 }
 
 func GetLibraryUUID(libPath string) (string, error) {
@@ -125,19 +121,63 @@ func GetLibraryUUID(libPath string) (string, error) {
 
 func BundlePath(fp string) (str string) {
 	m := re_fcpbundle.FindAllStringSubmatch(fp, -1)
-	if len(m) == 0 {
+	if len(m) == 0 || isIgnoredPath(fp) {
 		return str
 	}
-	if strings.Contains(fp, "/private/") {
-		return str
+	return "/" + m[0][1]
+}
+
+func isIgnoredPath(fp string) bool {
+	for _, s := range []string{"/private/", "Final Cut Backups", "__Temp"} {
+		if strings.Contains(fp, s) {
+			return true
+		}
 	}
-	if strings.Contains(fp, "Final Cut Backups") {
-		return str
+	return false
+}
+
+// BundleChange splits a path inside a bundle into the bundle, the event folder
+// (empty for files at the root of the bundle) and the kind of file that changed
+func BundleChange(fp string) (bundle, event, kind string) {
+	m := re_fcpbundle_file.FindAllStringSubmatch(fp, -1)
+	if len(m) == 0 || isIgnoredPath(fp) {
+		return "", "", ""
 	}
-	if strings.Contains(fp, "__Temp") {
-		return str
+	bundle = "/" + strings.TrimLeft(m[0][1], "/")
+	parts := strings.Split(m[0][2], "/")
+	filename := parts[len(parts)-1]
+	if len(parts) > 1 {
+		event = parts[0]
 	}
-	return "/" + m[0][1]
+	kind = CHANGE_OTHER
+	for _, part := range parts {
+		k, hasKey := changeFolders[part]
+		if hasKey {
+			return bundle, event, k
+		}
+	}
+	switch {
+	case strings.HasPrefix(filename, FCP_LIBRARY_DB):
+		kind = CHANGE_LIBRARY_DB
+	case strings.Contains(filename, FCP_EVENT_DB):
+		kind = CHANGE_EVENT_DB
+	}
+	return bundle, event, kind
+}
+
+// UpdateSource tells edits from what FCPX writes on its own. Renders, transcodes
+// and analysis run in the background, anything else counts as an edit unless
+// nobody touched the keyboard or mouse for IDLE_AFTER. An unknown idle time (-1)
+// is trusted to be someone at the desk.
+func UpdateSource(kind string, idle int64) string {
+	switch kind {
+	case CHANGE_RENDER, CHANGE_TRANSCODE, CHANGE_ANALYSIS:
+		return SOURCE_BACKGROUND
+	}
+	if idle >= int64(IDLE_AFTER.Seconds()) {
+		return SOURCE_BACKGROUND
+	}
+	return SOURCE_USER
 }
 
 func GetOpenFCPLibraries() (libs FCPLibraries, errs []error) {
@@ -151,8 +191,13 @@ func GetOpenFCPLibraries() (libs FCPLibraries, errs []error) {
 			err = errors.New("FCPX is not active")
 		}
 		errs = append(errs, err)
+		// Nothing is open, e.g. Final Cut quit
+		storageCache.Forget(map[string]bool{})
+		bundleUUIDs.Forget(map[string]bool{})
 		return libs, errs
 	} else if len(stdout) == 0 {
+		storageCache.Forget(map[string]bool{})
+		bundleUUIDs.Forget(map[string]bool{})
 		return libs, errs
 	}
 	captured := map[string]bool{}
@@ -167,14 +212,24 @@ func GetOpenFCPLibraries() (libs FCPLibraries, errs []error) {
 				lib, err := NewFCPProject(bundle)
 				if err != nil {
 					errs = append(errs, err)
+				} else {
+					// The library at this path might have been replaced
+					bundleUUIDs.Set(bundle, lib.UUID)
 				}
 				_, hasKey := libs[lib.UUID]
 				if hasKey {
 					continue
 				}
+				lib.Events, err = ReadLibraryEvents(bundle)
+				if err != nil {
+					errs = append(errs, err)
+				}
+				lib.Storage = storageCache.Get(bundle)
 				libs[lib.UUID] = &lib
 			}
 		}
 	}
+	storageCache.Forget(captured)
+	bundleUUIDs.Forget(captured)
 	return libs, errs
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsevents"
@@ -31,7 +32,49 @@ var noteDescription = map[fsevents.EventFlags]string{
 	fsevents.ItemIsSymlink:     "IsSymLink",
 }
 
-func WatcherPath(pathsToWatch []string, updateChan chan FCPLibrary, ctx context.Context) {
+// BundleUUIDs remembers the uuid of each bundle the watcher saw, so a change
+// doesn't read the library's plist. Scans refresh it and forget closed bundles,
+// see GetOpenFCPLibraries.
+type BundleUUIDs struct {
+	sync.Mutex
+	Entries map[string]string // bundle path -> uuid
+}
+
+var bundleUUIDs = &BundleUUIDs{Entries: map[string]string{}}
+
+func (self *BundleUUIDs) Get(bundle string) (string, error) {
+	self.Lock()
+	uuid, hasKey := self.Entries[bundle]
+	self.Unlock()
+	if hasKey {
+		return uuid, nil
+	}
+	lib, err := NewFCPProject(bundle)
+	if err != nil {
+		return "", err
+	}
+	self.Set(bundle, lib.UUID)
+	return lib.UUID, nil
+}
+
+func (self *BundleUUIDs) Set(bundle, uuid string) {
+	self.Lock()
+	defer self.Unlock()
+	self.Entries[bundle] = uuid
+}
+
+// Forget drops bundles that are no longer open
+func (self *BundleUUIDs) Forget(open map[string]bool) {
+	self.Lock()
+	defer self.Unlock()
+	for bundle, _ := range self.Entries {
+		if !open[bundle] {
+			delete(self.Entries, bundle)
+		}
+	}
+}
+
+func WatcherPath(pathsToWatch []string, updateChan chan ProjectUpdate, ctx context.Context) {
 	es := &fsevents.EventStream{
 		Paths:   pathsToWatch,
 		Latency: 1000 * time.Millisecond,
@@ -41,17 +84,31 @@ func WatcherPath(pathsToWatch []string, updateChan chan FCPLibrary, ctx context.
 	ec := es.Events
 	go func() {
 		for msg := range ec {
+			metrics.Add(METRIC_FSEVENTS, float64(len(msg)))
+			// Renders write hundreds of files per batch, only send one update per kind of change
+			sent := map[string]bool{}
 			for _, event := range msg {
 				// Note: event.Path doesn't have a starting slash
-				bundle := BundlePath(event.Path)
-				if bundle != "" {
-					lib, err := NewFCPProject(bundle)
-					if err != nil {
-						log.Println("[WARNING] [UPDATE] " + err.Error())
-					} else {
-						lib.Last = time.Now().Unix()
-						updateChan <- lib
-					}
+				bundle, eventFolder, kind := BundleChange(event.Path)
+				if bundle == "" {
+					continue
+				}
+				uuid, err := bundleUUIDs.Get(bundle)
+				if err != nil {
+					log.Println("[WARNING] [UPDATE] " + err.Error())
+					continue
+				}
+				key := uuid + eventFolder + kind
+				if sent[key] {
+					continue
+				}
+				sent[key] = true
+				metrics.Inc(METRIC_FSEVENT_UPDATES, "kind", kind)
+				updateChan <- ProjectUpdate{
+					UUID:  uuid,
+					Last:  time.Now().Unix(),
+					Event: eventFolder,
+					Kind:  kind,
 				}
 			}
 		}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HISTORY_STORE = "history.jsonl"
+
+	EVENT_CHECKOUT = "checkout"
+	EVENT_CLOSE    = "close"
+	EVENT_REMOVE   = "remove"
+	EVENT_UPDATE   = "update"
+	EVENT_CONFLICT = "conflict"
+)
+
+var (
+	// Activity updates arrive with every filesystem event, only record one per interval
+	historyUpdateInterval = int64(60)
+)
+
+type HistoryEvent struct {
+	T        int64    `json:"t"`
+	Kind     string   `json:"kind"`
+	UUID     string   `json:"uuid"`
+	Name     string   `json:"name,omitempty"`
+	Hostname string   `json:"hostname"`
+	Detail   string   `json:"detail,omitempty"`
+	Session  *Session `json:"session,omitempty"` // EVENT_SESSION only
+}
+
+type HistoryFilter struct {
+	UUID     string
+	Hostname string
+	Kind     string
+	Since    int64
+	Until    int64
+}
+
+func (self HistoryFilter) Match(ev HistoryEvent) bool {
+	if self.UUID != "" && self.UUID != ev.UUID {
+		return false
+	}
+	if self.Hostname != "" && self.Hostname != ev.Hostname {
+		return false
+	}
+	if self.Kind != "" && self.Kind != ev.Kind {
+		return false
+	}
+	if self.Since > 0 && ev.T < self.Since {
+		return false
+	}
+	if self.Until > 0 && ev.T > self.Until {
+		return false
+	}
+	return true
+}
+
+func NewHistory(fp string) *History {
+	return &History{
+		Path:   fp,
+		Events: []HistoryEvent{},
+	}
+}
+
+/*
+An append-only log of everything that happened to a library. Events are
+kept in memory for querying and appended to `Path`, one JSON object per line.
+*/
+type History struct {
+	sync.Mutex
+	Path   string
+	Events []HistoryEvent
+}
+
+func (self *History) Load() error {
+	self.Lock()
+	defer self.Unlock()
+	f, err := os.Open(self.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ev := HistoryEvent{}
+		if json.Unmarshal(scanner.Bytes(), &ev) == nil {
+			self.Events = append(self.Events, ev)
+		}
+	}
+	return scanner.Err()
+}
+
+func (self *History) Append(ev HistoryEvent) error {
+	self.Lock()
+	defer self.Unlock()
+	self.Events = append(self.Events, ev)
+	if self.Path == "" {
+		return nil
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(self.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+func (self *History) Query(filter HistoryFilter) []HistoryEvent {
+	self.Lock()
+	defer self.Unlock()
+	events := []HistoryEvent{}
+	for _, ev := range self.Events {
+		if filter.Match(ev) {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// ParseTime accepts unix seconds, RFC3339 or a plain date e.g. 2019-09-01
+func ParseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		return i, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, errors.New("Invalid time: " + s)
+}
+
+// Record writes an event to history, publishes it to the live stream, fires webhooks
+// and ends editing sessions
+func (self *Server) Record(kind, uuid, name, hostname, detail string) {
+	self.record(HistoryEvent{
+		T:        time.Now().Unix(),
+		Kind:     kind,
+		UUID:     uuid,
+		Name:     name,
+		Hostname: hostname,
+		Detail:   detail,
+	})
+}
+
+func (self *Server) record(ev HistoryEvent) {
+	err := self.History.Append(ev)
+	if err != nil {
+		LogError("[HISTORY] " + err.Error())
+	}
+	self.Broker.Publish(ev)
+	if self.IsSender() {
+		// Both servers of an HA pair record the same events
+		self.Webhooks.Fire(ev)
+	}
+	self.trackSessions(ev)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ICAL_TIME            = "20060102T150405Z"
+	DEFAULT_ICAL_RANGE   = 30 * 24 * time.Hour
+	ICAL_MAX_LINE_OCTETS = 75
+)
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// icalLine folds content lines longer than 75 octets as RFC 5545 asks
+func icalLine(b *bytes.Buffer, line string) {
+	for len(line) > ICAL_MAX_LINE_OCTETS {
+		cut := ICAL_MAX_LINE_OCTETS
+		// Don't split a multi-byte character
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n")
+		line = " " + line[cut:]
+	}
+	b.WriteString(line + "\r\n")
+}
+
+func icalTime(t int64) string {
+	return time.Unix(t, 0).UTC().Format(ICAL_TIME)
+}
+
+// Calendar renders sessions as VEVENTs, open sessions end at `now`
+func Calendar(name string, sessions []Session, now int64) []byte {
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Start < sessions[j].Start
+	})
+
+	b := &bytes.Buffer{}
+	icalLine(b, "BEGIN:VCALENDAR")
+	icalLine(b, "VERSION:2.0")
+	icalLine(b, "PRODID:-//TTWP//FCPXMonitor//EN")
+	icalLine(b, "CALSCALE:GREGORIAN")
+	icalLine(b, "METHOD:PUBLISH")
+	icalLine(b, "X-WR-CALNAME:"+icalEscaper.Replace(name))
+
+	for _, s := range sessions {
+		project := strings.Replace(s.Name, ".fcpbundle", "", 1)
+		if project == "" {
+			project = s.UUID
+		}
+		summary := fmt.Sprintf("%s · %s", project, s.Hostname)
+		end := s.End
+		status := "ended: " + s.Reason
+		if end == 0 {
+			end = now
+			summary += " (in progress)"
+			status = "in progress"
+		}
+		if end <= s.Start {
+			// Zero length events show up badly in most calendars
+			end = s.Start + 60
+		}
+		description := fmt.Sprintf("%d updates, %s\nLibrary %s", s.Updates, status, s.UUID)
+		icalLine(b, "BEGIN:VEVENT")
+		icalLine(b, fmt.Sprintf("UID:%s-%s-%d@fcpxmonitor", s.Hostname, s.UUID, s.Start))
+		icalLine(b, "DTSTAMP:"+icalTime(now))
+		icalLine(b, "DTSTART:"+icalTime(s.Start))
+		icalLine(b, "DTEND:"+icalTime(end))
+		icalLine(b, "SUMMARY:"+icalEscaper.Replace(summary))
+		icalLine(b, "DESCRIPTION:"+icalEscaper.Replace(description))
+		icalLine(b, "LOCATION:"+icalEscaper.Replace(s.Hostname))
+		icalLine(b, "CATEGORIES:"+icalEscaper.Replace(project))
+		icalLine(b, "TRANSP:TRANSPARENT")
+		icalLine(b, "END:VEVENT")
+	}
+
+	icalLine(b, "END:VCALENDAR")
+	return b.Bytes()
+
+}
+
+// GET_Calendar is a feed calendar clients can subscribe to, for the whole studio
+// or narrowed to one host and/or library e.g. /calendar.ics?hostname=suite2
+func (self *Server) GET_Calendar(c *gin.Context) {
+
+	since, err := ParseTime(c.Query("since"))
+	if err != nil {
+		JSONError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now().Unix()
+	if since == 0 {
+		since = now - int64(DEFAULT_ICAL_RANGE.Seconds())
+	}
+
+	uuid, hostname := c.Query("uuid"), c.Query("hostname")
+	sessions := self.QuerySessions(uuid, hostname, since)
+
+	name := "Studio"
+	if uuid != "" {
+		name = uuid
+		for _, s := range sessions {
+			if s.Name != "" {
+				name = strings.Replace(s.Name, ".fcpbundle", "", 1)
+			}
+		}
+	}
+	if hostname != "" {
+		if uuid != "" {
+			name += " · " + hostname
+		} else {
+			name = hostname
+		}
+	}
+
+	c.Header("Content-Disposition", `inline; filename="fcpxmonitor.ics"`)
+	c.Data(200, "text/calendar; charset=utf-8", Calendar("FCPX "+name, sessions, now))
+
+}
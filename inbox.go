@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	INBOX_STORE    = "inbox.json"
+	INBOX_SIZE     = 500
+	INBOX_MAX_AGE  = 7 * 24 * time.Hour // Undelivered messages older than this are dropped
+	RECEIPT_QUEUED = "queued"
+)
+
+type InboxMessage struct {
+	ID         string              `json:"id"`
+	Message    string              `json:"message"`
+	T          int64               `json:"t"`
+	Recipients map[string]*Receipt `json:"recipients"`
+}
+
+type Receipt struct {
+	Status    string `json:"status"`              // DELIVERED or RECEIPT_QUEUED
+	Delivered int64  `json:"delivered,omitempty"` // unix time
+	Error     string `json:"error,omitempty"`     // Why the last attempt failed
+}
+
+type InboxAck struct {
+	IDs []string `json:"ids"`
+}
+
+func NewInbox(fp string) *Inbox {
+	return &Inbox{Path: fp, Messages: []*InboxMessage{}}
+}
+
+// Inbox keeps messages sent through /broadcast until every recipient got them
+type Inbox struct {
+	sync.Mutex
+	Path     string
+	Messages []*InboxMessage // Oldest first
+}
+
+func (self *Inbox) Load() error {
+	self.Lock()
+	defer self.Unlock()
+	if self.Path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(self.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &self.Messages)
+}
+
+// save writes the inbox like Library.Save. The caller must hold the lock.
+func (self *Inbox) save() {
+	if self.Path == "" {
+		return
+	}
+	b, err := json.Marshal(self.Messages)
+	if err == nil {
+		tmp := self.Path + ".tmp"
+		err = ioutil.WriteFile(tmp, b, 0644)
+		if err == nil {
+			err = os.Rename(tmp, self.Path)
+		}
+	}
+	if err != nil {
+		LogError("[INBOX] " + err.Error())
+	}
+}
+
+// Add records a message and how the first delivery attempt went for each recipient
+func (self *Inbox) Add(message string, deliveries map[string]Delivery) *InboxMessage {
+	self.Lock()
+	defer self.Unlock()
+	now := time.Now()
+	m := &InboxMessage{
+		ID:         strconv.FormatInt(now.UnixNano(), 36),
+		Message:    message,
+		T:          now.Unix(),
+		Recipients: map[string]*Receipt{},
+	}
+	for hostname, d := range deliveries {
+		if d.Status == DELIVERED {
+			m.Recipients[hostname] = &Receipt{Status: DELIVERED, Delivered: now.Unix()}
+		} else {
+			m.Recipients[hostname] = &Receipt{Status: RECEIPT_QUEUED, Error: d.Error}
+		}
+	}
+	self.Messages = append(self.Messages, m)
+	self.prune(now)
+	self.save()
+	return m
+}
+
+// prune drops the oldest messages past INBOX_SIZE and expired ones. The caller must hold the lock.
+func (self *Inbox) prune(now time.Time) {
+	kept := []*InboxMessage{}
+	for _, m := range self.Messages {
+		if now.Sub(time.Unix(m.T, 0)) < INBOX_MAX_AGE {
+			kept = append(kept, m)
+		}
+	}
+	if len(kept) > INBOX_SIZE {
+		kept = kept[len(kept)-INBOX_SIZE:]
+	}
+	self.Messages = kept
+}
+
+// Pending returns the messages `hostname` has yet to receive, oldest first
+func (self *Inbox) Pending(hostname string) []InboxMessage {
+	self.Lock()
+	defer self.Unlock()
+	pending := []InboxMessage{}
+	for _, m := range self.Messages {
+		r, hasKey := m.Recipients[hostname]
+		if hasKey && r.Status != DELIVERED {
+			pending = append(pending, InboxMessage{ID: m.ID, Message: m.Message, T: m.T})
+		}
+	}
+	return pending
+}
+
+// Ack marks messages as delivered to `hostname`, returns how many changed
+func (self *Inbox) Ack(hostname string, ids []string) int {
+	self.Lock()
+	defer self.Unlock()
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	n := 0
+	for _, m := range self.Messages {
+		r, hasKey := m.Recipients[hostname]
+		if wanted[m.ID] && hasKey && r.Status != DELIVERED {
+			r.Status = DELIVERED
+			r.Delivered = time.Now().Unix()
+			r.Error = ""
+			n += 1
+		}
+	}
+	if n > 0 {
+		self.save()
+	}
+	return n
+}
+
+func (self *Server) GET_Messages(c *gin.Context) {
+	hostname := c.Query("hostname")
+	self.Inbox.Lock()
+	defer self.Inbox.Unlock()
+	messages := []*InboxMessage{}
+	for i := len(self.Inbox.Messages) - 1; i >= 0; i-- {
+		m := self.Inbox.Messages[i]
+		if _, hasKey := m.Recipients[hostname]; hostname == "" || hasKey {
+			messages = append(messages, m)
+		}
+	}
+	c.JSON(200, gin.H{"messages": messages})
+}
+
+func (self *Server) GET_Inbox(c *gin.Context) {
+	c.JSON(200, self.Inbox.Pending(c.Param("hostname")))
+}
+
+func (self *Server) POST_InboxAck(c *gin.Context) {
+	ack := InboxAck{}
+	err := c.ShouldBindJSON(&ack)
+	if err != nil {
+		JSONError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"acked": self.Inbox.Ack(c.Param("hostname"), ack.IDs)})
+}
+
+// FetchInbox shows the messages the servers kept for us while we were away
+func (self *Client) FetchInbox() {
+	self.Broadcast("_inbox/"+self.Hostname, NOBODY, func(server string, body []byte) {
+		pending := []InboxMessage{}
+		err := json.Unmarshal(body, &pending)
+		if err != nil {
+			LogError(fmt.Sprintf("[%s] [INBOX] %s", server, err.Error()))
+			return
+		}
+		if len(pending) == 0 {
+			return
+		}
+		ack := InboxAck{IDs: []string{}}
+		for _, m := range pending {
+			sent := time.Unix(m.T, 0).Format("Mon 3:04pm")
+			self.ShowNotification(fmt.Sprintf("%s (sent %s)", m.Message, sent))
+			ack.IDs = append(ack.IDs, m.ID)
+		}
+		b, _ := json.Marshal(ack)
+		err = self.Send(server, "_inbox/"+self.Hostname+"/ack", b, CBTODO)
+		if err != nil {
+			LogError(fmt.Sprintf("[%s] [INBOX] %s", server, err.Error()))
+		}
+	})
+}
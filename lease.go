@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	DEFAULT_LEASE_TTL = 15 * time.Minute
+	EVENT_EXPIRED     = "expired"
+)
+
+type Expired struct {
+	UUID     string
+	Name     string
+	Hostname string
+}
+
+func (self *Library) leaseTTL() time.Duration {
+	if self.LeaseTTL == 0 {
+		return DEFAULT_LEASE_TTL
+	}
+	return self.LeaseTTL
+}
+
+func (self *Library) Lease() int64 {
+	return time.Now().Add(self.leaseTTL()).Unix()
+}
+
+// ExpireLeases drops every checkout whose lease ran out before `now`. A project
+// left without checkouts is removed, with the last host that worked on it.
+func (self *Library) ExpireLeases(now int64) (expired []Expired, removed []Expired) {
+	expired = []Expired{}
+	removed = []Expired{}
+	for uuid, project := range self.Projects {
+		lastHost, last := "", int64(-1)
+		for host, chk := range project.Checkouts {
+			if chk.Expires > 0 && chk.Expires < now {
+				delete(project.Checkouts, host)
+				project.ForgetActivity(host)
+				self.Touch(STAMP_CHECKOUT, uuid, host, true)
+				expired = append(expired, Expired{uuid, project.Name, host})
+				if chk.Last > last || (chk.Last == last && host < lastHost) {
+					lastHost, last = host, chk.Last
+				}
+			}
+		}
+		if len(project.Checkouts) == 0 {
+			delete(self.Projects, uuid)
+			removed = append(removed, Expired{uuid, project.Name, lastHost})
+		}
+	}
+	return expired, removed
+}
+
+func (self *Server) ExpireLeases() {
+
+	self.Library.Lock()
+	defer self.Library.Unlock()
+
+	self.Library.CompactStamps(time.Now())
+
+	expired, removed := self.Library.ExpireLeases(time.Now().Unix())
+	if len(expired) == 0 {
+		return
+	}
+
+	for _, ex := range expired {
+		log.Printf("⌛️ [%s] [EXPIRED] %s", ex.Hostname, ex.UUID)
+		self.Record(EVENT_EXPIRED, ex.UUID, ex.Name, ex.Hostname, "checkout expired")
+	}
+	for _, ex := range removed {
+		self.Record(EVENT_REMOVE, ex.UUID, ex.Name, ex.Hostname, "")
+	}
+
+	self.ReconcileConflicts()
+	self.SaveLibrary()
+
+}
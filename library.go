@@ -4,42 +4,90 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
 	"sync"
+	"time"
 )
 
 /*
                     |- Name
+                    |- Events
+                    |- Activity[event][hostname]
+                    |- Storage
+                    |- Versions
 	Library[uuid] --|- Checkouts[hostname] --|- Path
                                              |- Last
+                                             |- Expires
+                                             |- Unconfirmed
 */
 
 type Project struct {
-	Name      string               `json:"name"`
-	Info      map[string]string    `json:"info"`
-	Checkouts map[string]*Checkout `json:"checkouts"`
+	Name      string                               `json:"name"`
+	Info      map[string]string                    `json:"info"`
+	Events    []FCPEvent                           `json:"events"`
+	Activity  map[string]map[string]*EventActivity `json:"activity"` // event folder -> hostname
+	Storage   *BundleStorage                       `json:"storage,omitempty"`
+	Versions  []Deliverable                        `json:"versions"`
+	Checkouts map[string]*Checkout                 `json:"checkouts"`
+}
+
+// ForgetActivity drops what a host did in the events once its checkout is gone,
+// the activity of the other hosts is kept until the project goes
+func (self *Project) ForgetActivity(host string) {
+	for event, hosts := range self.Activity {
+		delete(hosts, host)
+		if len(hosts) == 0 {
+			delete(self.Activity, event)
+		}
+	}
+}
+
+type EventActivity struct {
+	Last   int64  `json:"last"`
+	Kind   string `json:"kind"`
+	Source string `json:"source,omitempty"`
 }
 
 type Checkout struct {
-	Path string `json:"path"`
-	Last int64  `json:"last"`
+	Path        string `json:"path"`
+	Last        int64  `json:"last"`
+	Expires     int64  `json:"expires"`               // Renewed by every checkout or update from the host
+	Unconfirmed bool   `json:"unconfirmed,omitempty"` // Restored from disk, the client has yet to report in
 }
 
 type ProjectUpdate struct {
 	Hostname string `json:"hostname"`
 	UUID     string `json:"uuid"`
 	Last     int64  `json:"last"`
+	Event    string `json:"event,omitempty"`  // Event folder inside the bundle
+	Kind     string `json:"kind,omitempty"`   // See CHANGE_*
+	Source   string `json:"source,omitempty"` // See SOURCE_*, older clients don't send it
+}
+
+// Background updates keep the checkout alive but aren't edits
+func (self ProjectUpdate) Background() bool {
+	return self.Source == SOURCE_BACKGROUND
 }
 
 func NewLibrary() Library {
 	return Library{
-		Projects: map[string]*Project{},
+		Projects:      map[string]*Project{},
+		Reservations:  map[string]*Reservation{},
+		Timelines:     map[string][]VersionEvent{},
+		Subscriptions: map[string][]string{},
+		Stamps:        map[string]Stamp{},
 	}
 }
 
 type Library struct {
 	sync.Mutex
-	Projects map[string]*Project `json:"library"`
+	Projects      map[string]*Project       `json:"library"`
+	Reservations  map[string]*Reservation   `json:"reservations"`
+	Timelines     map[string][]VersionEvent `json:"timelines"`     // uuid -> every deliverable ever seen, outlives the project
+	Subscriptions map[string][]string       `json:"subscriptions"` // uuid -> hosts notified of new versions
+	Stamps        map[string]Stamp          `json:"stamps"`        // See replication.go
+	LeaseTTL      time.Duration             `json:"-"`
 }
 
 func (self *Library) HasProject(uuid string) bool {
@@ -47,15 +95,59 @@ func (self *Library) HasProject(uuid string) bool {
 	return hasKey
 }
 
+func (self *Library) HasCheckout(uuid, host string) bool {
+	if !self.HasProject(uuid) {
+		return false
+	}
+	_, hasKey := self.Projects[uuid].Checkouts[host]
+	return hasKey
+}
+
+// SetMetadata keeps what a client reported about a project, a nil field is left
+// as it was. The project is stamped when anything but the storage scan time
+// changed. The caller must hold the lock.
+func (self *Library) SetMetadata(uuid string, lib *FCPLibrary) {
+	project, hasKey := self.Projects[uuid]
+	if !hasKey {
+		return
+	}
+	changed := false
+	if lib.Events != nil && !reflect.DeepEqual(project.Events, lib.Events) {
+		project.Events = lib.Events
+		changed = true
+	}
+	if lib.Storage != nil {
+		if project.Storage == nil || !sameStorage(*project.Storage, *lib.Storage) {
+			changed = true
+		}
+		project.Storage = lib.Storage
+	}
+	if lib.Versions != nil && !reflect.DeepEqual(project.Versions, lib.Versions) {
+		project.Versions = lib.Versions
+		changed = true
+	}
+	if changed {
+		self.Touch(STAMP_PROJECT, uuid, "", false)
+	}
+}
+
+func sameStorage(a, b BundleStorage) bool {
+	a.Scanned, b.Scanned = 0, 0
+	return a == b
+}
+
 func (self *Library) CheckoutProject(uuid, name, host, path string, info map[string]string) error {
 	if !self.HasProject(uuid) {
+		self.Touch(STAMP_PROJECT, uuid, "", false)
+		self.Touch(STAMP_CHECKOUT, uuid, host, false)
 		self.Projects[uuid] = &Project{
 			Name: name,
 			Info: info,
 			Checkouts: map[string]*Checkout{
 				host: &Checkout{
-					Path: path,
-					Last: 0,
+					Path:    path,
+					Last:    0,
+					Expires: self.Lease(),
 				},
 			},
 		}
@@ -63,14 +155,24 @@ func (self *Library) CheckoutProject(uuid, name, host, path string, info map[str
 	}
 	checkouts := self.Projects[uuid].Checkouts
 	cc, hasKey := checkouts[host]
-	self.Projects[uuid].Info = info
+	if !reflect.DeepEqual(self.Projects[uuid].Info, info) {
+		self.Touch(STAMP_PROJECT, uuid, "", false)
+		self.Projects[uuid].Info = info
+	}
 	if !hasKey {
+		self.Touch(STAMP_CHECKOUT, uuid, host, false)
 		checkouts[host] = &Checkout{
-			Path: path,
-			Last: 0,
+			Path:    path,
+			Last:    0,
+			Expires: self.Lease(),
+		}
+	} else {
+		cc.Expires = self.Lease()
+		cc.Unconfirmed = false
+		if cc.Path != path {
+			self.Touch(STAMP_CHECKOUT, uuid, host, false)
+			cc.Path = path
 		}
-	} else if cc.Path != path {
-		cc.Path = path
 	}
 	otherhosts := []string{}
 	for currHost, _ := range checkouts {
@@ -93,7 +195,25 @@ func (self *Library) Update(update ProjectUpdate) (int, error) {
 	if !hasKey {
 		return http.StatusForbidden, errors.New("No previous checkout from " + update.Hostname)
 	}
-	chk.Last = Latest(update.Last, chk.Last)
+	if !update.Background() {
+		chk.Last = Latest(update.Last, chk.Last)
+	}
+	chk.Expires = self.Lease()
+	chk.Unconfirmed = false
+	if update.Event != "" {
+		project := self.Projects[update.UUID]
+		if project.Activity == nil {
+			project.Activity = map[string]map[string]*EventActivity{}
+		}
+		if project.Activity[update.Event] == nil {
+			project.Activity[update.Event] = map[string]*EventActivity{}
+		}
+		project.Activity[update.Event][update.Hostname] = &EventActivity{
+			Last:   update.Last,
+			Kind:   update.Kind,
+			Source: update.Source,
+		}
+	}
 	return 0, nil
 }
 
@@ -104,6 +224,8 @@ func (self *Library) DeregisterProjects(host string, openedProjects map[string]b
 		_, hasKey := project.Checkouts[host]
 		if hasKey && !openedProjects[uuid] {
 			delete(project.Checkouts, host)
+			project.ForgetActivity(host)
+			self.Touch(STAMP_CHECKOUT, uuid, host, true)
 			closed = append(closed, uuid)
 		}
 	}
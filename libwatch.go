@@ -14,7 +14,11 @@ mainLoop:
 		case <-ctx.Done():
 			break mainLoop
 		case <-tickChan:
+			t := time.Now()
 			libs, errs := GetOpenFCPLibraries()
+			metrics.Since(METRIC_LSOF_SCAN, t)
+			lastScan.Set(t, libs, errs)
+			metrics.Add(METRIC_LSOF_ERRORS, float64(len(errs)))
 			if len(errs) > 0 {
 				for _, err := range errs {
 					msg := "[WARNING] " + err.Error()
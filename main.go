@@ -16,11 +16,22 @@ import (
 const (
 	SERVER = "server"
 	CLIENT = "client"
+	REPORT = "report"
 )
 
 var (
-	re_mode = regexp.MustCompile(`^(server|client)$`)
-	_mode   = kingpin.Arg("mode", "Run mode: server|client").Required().String()
+	re_mode   = regexp.MustCompile(`^(server|client|report)$`)
+	_mode     = kingpin.Arg("mode", "Run mode: server|client|report").Required().String()
+	_since    = kingpin.Flag("since", "Report: start of the range, unix time, RFC3339 or 2006-01-02 (default a week ago)").String()
+	_until    = kingpin.Flag("until", "Report: end of the range (default now)").String()
+	_format   = kingpin.Flag("format", "Report: json|csv").Default(REPORT_CSV).String()
+	_history  = kingpin.Flag("history", "Report: server history file (default the one next to this app)").String()
+	_lease    = kingpin.Flag("lease", "Server: how long a checkout lasts without its client reporting in").Default("15m").Duration()
+	_secret   = kingpin.Flag("secret", "Shared team secret used to sign traffic between nodes, empty disables auth").Envar("FCPXM_SECRET").String()
+	_idle     = kingpin.Flag("idle", "Server: how long without activity before an editing session ends").Default("10m").Duration()
+	_webhooks = kingpin.Flag("webhooks", "Server: JSON file of webhooks fired on library events").String()
+	_groups   = kingpin.Flag("groups", "Server: JSON file of named groups of hosts to target messages at").String()
+	_versions = kingpin.Flag("versions", "Client: JSON file of deliverable folder and version patterns").String()
 )
 
 func main() {
@@ -32,7 +43,12 @@ func main() {
 	mode := *_mode
 
 	if !re_mode.MatchString(mode) {
-		LogFatal("Invalid mode. Options are 'server' or 'client'")
+		LogFatal("Invalid mode. Options are 'server', 'client' or 'report'")
+	}
+
+	teamSecret = []byte(*_secret)
+	if len(teamSecret) == 0 {
+		LogWarning("No team secret, requests between nodes are not authenticated")
 	}
 
 	hostname, err := os.Hostname()
@@ -58,6 +74,18 @@ func main() {
 		LogFatal(err.Error())
 	}
 
+	if mode == REPORT {
+		historyPath := *_history
+		if historyPath == "" {
+			historyPath = filepath.Join(runDir, HISTORY_STORE)
+		}
+		err = RunReport(historyPath, *_since, *_until, *_format)
+		if err != nil {
+			LogFatal(err.Error())
+		}
+		return
+	}
+
 	version := "no_version"
 
 	// Start the self updater
@@ -70,6 +98,19 @@ func main() {
 	}
 
 	txtRecord := &StringMap{"version": version}
+
+	// Peers pin this certificate's fingerprint from the TXT record
+	cert, fp, err := LoadOrCreateCertificate(runDir, hostname)
+	if err != nil {
+		LogWarning("TLS disabled | " + err.Error())
+	} else {
+		nodeCertificate = &cert
+		(*txtRecord)["fp"] = fp
+	}
+	err = knownHosts.Load(filepath.Join(runDir, KNOWN_HOSTS))
+	if err != nil {
+		LogWarning("[TLS] " + err.Error())
+	}
 	service := NewService(hostname, port[mode], serviceName[mode], txtRecord)
 
 	// Start autodiscovery service
@@ -77,6 +118,12 @@ func main() {
 
 	switch mode {
 	case CLIENT:
+		if *_versions != "" {
+			versionRules, err = LoadVersionRules(*_versions)
+			if err != nil {
+				LogFatal(err.Error())
+			}
+		}
 		client := NewClient(service)
 		err = client.Start() // Blocking main loop
 		if err != nil {
@@ -84,6 +131,21 @@ func main() {
 		}
 	case SERVER:
 		server := NewServer(service)
+		server.Library.LeaseTTL = *_lease
+		server.Sessions.Idle = *_idle
+		if *_webhooks != "" {
+			hooks, err := LoadWebhooks(*_webhooks)
+			if err != nil {
+				LogFatal(err.Error())
+			}
+			server.Webhooks = NewWebhooks(hooks)
+		}
+		if *_groups != "" {
+			server.Groups, err = LoadGroups(*_groups)
+			if err != nil {
+				LogFatal(err.Error())
+			}
+		}
 		err = server.Start() // Blocking main loop
 		if err != nil {
 			LogError(err.Error())
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+	groups.json
+	{
+		"suites": ["suite1", "suite2"],
+		"assist": ["assist1"]
+	}
+*/
+
+// Groups are named lists of hosts to target messages at
+type Groups map[string][]string
+
+func LoadGroups(fp string) (Groups, error) {
+	groups := Groups{}
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return groups, err
+	}
+	err = json.Unmarshal(b, &groups)
+	return groups, err
+}
+
+// TargetedMessage goes to every member unless at least one target is set
+type TargetedMessage struct {
+	NotifyMessage
+	Hosts []string `json:"hosts"` // These hosts
+	UUID  string   `json:"uuid"`  // Hosts that have this library open
+	Group string   `json:"group"` // Hosts in this group, see Groups
+}
+
+func (self TargetedMessage) Targeted() bool {
+	return len(self.Hosts) > 0 || self.UUID != "" || self.Group != ""
+}
+
+type MessageResult struct {
+	ID         string              `json:"id"` // In the inbox, see GET /messages
+	Recipients map[string]Delivery `json:"recipients"`
+	Delivered  int                 `json:"delivered"`
+	Failed     int                 `json:"failed"`
+}
+
+// Recipients resolves the targets of a message to hostnames. The caller must hold the lock.
+func (self *Server) Recipients(m TargetedMessage) ([]string, int, string) {
+	hosts := map[string]bool{}
+	if !m.Targeted() {
+		for hostname, _ := range self.Service.MemberList() {
+			hosts[hostname] = true
+		}
+	}
+	for _, hostname := range m.Hosts {
+		hosts[hostname] = true
+	}
+	if m.UUID != "" {
+		project, hasKey := self.Library.Projects[m.UUID]
+		if !hasKey {
+			return nil, http.StatusNotFound, "Project does not exist: " + m.UUID
+		}
+		for hostname, _ := range project.Checkouts {
+			hosts[hostname] = true
+		}
+	}
+	if m.Group != "" {
+		group, hasKey := self.Groups[m.Group]
+		if !hasKey {
+			return nil, http.StatusNotFound, "No such group: " + m.Group
+		}
+		for _, hostname := range group {
+			hosts[hostname] = true
+		}
+	}
+	recipients := []string{}
+	for hostname, _ := range hosts {
+		recipients = append(recipients, hostname)
+	}
+	sort.Strings(recipients)
+	return recipients, 0, ""
+}
+
+// SendMessage notifies every recipient and waits to know how it went
+func (self *Server) SendMessage(recipients []string, m NotifyMessage) MessageResult {
+	b, _ := json.Marshal(m)
+	result := MessageResult{Recipients: self.SendEach(recipients, "notify", b)}
+	for _, d := range result.Recipients {
+		if d.Status == DELIVERED {
+			result.Delivered += 1
+		} else {
+			result.Failed += 1
+		}
+	}
+	return result
+}
+
+func (self *Server) POST_Broadcast(c *gin.Context) {
+	m := TargetedMessage{}
+	err := c.ShouldBindJSON(&m)
+	if err != nil {
+		JSONError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if m.Message == "" {
+		JSONError(c, http.StatusBadRequest, "Empty message")
+		return
+	}
+	self.Library.Lock()
+	recipients, status, msg := self.Recipients(m)
+	self.Library.Unlock()
+	if status != 0 {
+		JSONError(c, status, msg)
+		return
+	}
+	result := self.SendMessage(recipients, m.NotifyMessage)
+	// Whoever missed it gets it from the inbox when they're back
+	result.ID = self.Inbox.Add(m.Message, result.Recipients).ID
+	c.JSON(200, result)
+}
+
+func (self *Server) GET_Groups(c *gin.Context) {
+	c.JSON(200, self.Groups)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+	METRIC_OPEN_PROJECTS   = "fcpxmonitor_open_projects"
+	METRIC_CHECKOUTS       = "fcpxmonitor_checkouts"
+	METRIC_CONFLICTS       = "fcpxmonitor_conflicts"
+	METRIC_MEMBERS         = "fcpxmonitor_members"
+	METRIC_MEMBERS_AWOL    = "fcpxmonitor_members_awol"
+	METRIC_MEMBER_RTT      = "fcpxmonitor_member_rtt_milliseconds"
+	METRIC_AFK             = "fcpxmonitor_afk_seconds"
+	METRIC_BROADCAST       = "fcpxmonitor_broadcast_total"
+	METRIC_LSOF_SCAN       = "fcpxmonitor_lsof_scan_seconds"
+	METRIC_LSOF_ERRORS     = "fcpxmonitor_lsof_scan_errors_total"
+	METRIC_FSEVENTS        = "fcpxmonitor_fsevents_total"
+	METRIC_FSEVENT_UPDATES = "fcpxmonitor_fsevents_updates_total"
+)
+
+// Global registry, both modes write to it and serve it at /metrics
+var metrics = NewMetrics(map[string][2]string{
+	METRIC_OPEN_PROJECTS:   {"gauge", "Libraries currently open (client) or checked out anywhere (server)."},
+	METRIC_CHECKOUTS:       {"gauge", "Checkouts held by each host."},
+	METRIC_CONFLICTS:       {"gauge", "Libraries open on more than one host."},
+	METRIC_MEMBERS:         {"gauge", "Members discovered over mDNS."},
+	METRIC_MEMBERS_AWOL:    {"gauge", "Members that failed to answer the last request."},
+	METRIC_MEMBER_RTT:      {"gauge", "Last measured round trip time to each member."},
+	METRIC_AFK:             {"gauge", "Seconds since the last USB activity reported by each host."},
+	METRIC_BROADCAST:       {"counter", "Requests sent to members by route and result."},
+	METRIC_LSOF_SCAN:       {"summary", "Time spent scanning for open libraries with lsof."},
+	METRIC_LSOF_ERRORS:     {"counter", "Errors returned while scanning for open libraries."},
+	METRIC_FSEVENTS:        {"counter", "Raw filesystem events received."},
+	METRIC_FSEVENT_UPDATES: {"counter", "Library updates derived from filesystem events by kind of change."},
+})
+
+func NewMetrics(descriptions map[string][2]string) *Metrics {
+	return &Metrics{
+		Descriptions: descriptions,
+		Series:       map[string]map[string]float64{},
+	}
+}
+
+type Metrics struct {
+	sync.Mutex
+	Descriptions map[string][2]string          // name -> type, help
+	Series       map[string]map[string]float64 // name -> labels -> value
+}
+
+// Labels are given as key, value pairs
+func metricLabels(labels []string) string {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], v))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (self *Metrics) series(name string) map[string]float64 {
+	s, hasKey := self.Series[name]
+	if !hasKey {
+		s = map[string]float64{}
+		self.Series[name] = s
+	}
+	return s
+}
+
+func (self *Metrics) Add(name string, value float64, labels ...string) {
+	self.Lock()
+	defer self.Unlock()
+	self.series(name)[metricLabels(labels)] += value
+}
+
+func (self *Metrics) Inc(name string, labels ...string) {
+	self.Add(name, 1, labels...)
+}
+
+func (self *Metrics) Set(name string, value float64, labels ...string) {
+	self.Lock()
+	defer self.Unlock()
+	self.series(name)[metricLabels(labels)] = value
+}
+
+// Reset drops every series of a gauge so hosts that went away disappear
+func (self *Metrics) Reset(name string) {
+	self.Lock()
+	defer self.Unlock()
+	self.Series[name] = map[string]float64{}
+}
+
+// Observe feeds a summary, exported as _sum and _count
+func (self *Metrics) Observe(name string, value float64) {
+	self.Lock()
+	defer self.Unlock()
+	self.series(name + "_sum")[""] += value
+	self.series(name + "_count")[""] += 1
+}
+
+func (self *Metrics) Since(name string, t time.Time) {
+	self.Observe(name, time.Since(t).Seconds())
+}
+
+func (self *Metrics) Text() []byte {
+	self.Lock()
+	defer self.Unlock()
+
+	names := []string{}
+	for name, _ := range self.Descriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := &bytes.Buffer{}
+	for _, name := range names {
+		desc := self.Descriptions[name]
+		fmt.Fprintf(b, "# HELP %s %s\n", name, desc[1])
+		fmt.Fprintf(b, "# TYPE %s %s\n", name, desc[0])
+		suffixes := []string{""}
+		if desc[0] == "summary" {
+			suffixes = []string{"_sum", "_count"}
+		}
+		for _, suffix := range suffixes {
+			s := self.Series[name+suffix]
+			keys := []string{}
+			for labels, _ := range s {
+				keys = append(keys, labels)
+			}
+			sort.Strings(keys)
+			for _, labels := range keys {
+				fmt.Fprintf(b, "%s%s%s %g\n", name, suffix, labels, s[labels])
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// Only the first path segment, "_afk/host/120" would make a series per sample
+func metricRoute(route string) string {
+	return strings.SplitN(route, "/", 2)[0]
+}
+
+func (self *Host) CollectMetrics() {
+	metrics.Set(METRIC_MEMBERS, float64(len(self.Service.MemberList())))
+	self.HealthLock.Lock()
+	defer self.HealthLock.Unlock()
+	metrics.Set(METRIC_MEMBERS_AWOL, float64(len(self.AWOL)))
+	metrics.Reset(METRIC_MEMBER_RTT)
+	for hostname, rtt := range self.ResponseTimes {
+		metrics.Set(METRIC_MEMBER_RTT, rtt, "hostname", hostname)
+	}
+}
+
+func (self *Server) GET_Metrics(c *gin.Context) {
+
+	self.Library.Lock()
+	metrics.Set(METRIC_OPEN_PROJECTS, float64(len(self.Library.Projects)))
+	metrics.Set(METRIC_CONFLICTS, float64(len(self.Conflicts)))
+	checkouts := map[string]int{}
+	for _, project := range self.Library.Projects {
+		for hostname, _ := range project.Checkouts {
+			checkouts[hostname] += 1
+		}
+	}
+	self.Library.Unlock()
+
+	metrics.Reset(METRIC_CHECKOUTS)
+	for hostname, n := range checkouts {
+		metrics.Set(METRIC_CHECKOUTS, float64(n), "hostname", hostname)
+	}
+
+	self.AFK.Lock()
+	metrics.Reset(METRIC_AFK)
+	for hostname, seconds := range self.AFK.Map {
+		metrics.Set(METRIC_AFK, float64(seconds), "hostname", hostname)
+	}
+	self.AFK.Unlock()
+
+	self.CollectMetrics()
+	c.Data(200, PROMETHEUS_CONTENT_TYPE, metrics.Text())
+
+}
+
+func (self *Client) GET_Metrics(c *gin.Context) {
+	metrics.Set(METRIC_OPEN_PROJECTS, float64(len(self.Library)))
+	self.CollectMetrics()
+	c.Data(200, PROMETHEUS_CONTENT_TYPE, metrics.Text())
+}
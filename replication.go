@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	STAMP_CHECKOUT     = "checkout"
+	STAMP_PROJECT      = "project"
+	STAMP_RESERVATION  = "reservation"
+	STAMP_SUBSCRIPTION = "subscription"
+
+	// A peer offline longer than this may bring back something that was deleted
+	TOMBSTONE_TTL = 24 * time.Hour
+
+	// Changes are pushed at most this often, not on every update
+	REPLICATE_INTERVAL = 10 * time.Second
+)
+
+// MERGE_ORDER is the order kinds are merged in, checkouts first so projects
+// exist when their metadata is merged
+var MERGE_ORDER = map[string]int{
+	STAMP_CHECKOUT:     0,
+	STAMP_PROJECT:      1,
+	STAMP_RESERVATION:  2,
+	STAMP_SUBSCRIPTION: 3,
+}
+
+/*
+	Servers replicate the Library as a last-writer-wins map. Every local change
+	to a checkout, project, reservation or subscription stamps its key, deletes
+	leave a tombstone. Merging keeps the newest stamp per key. Values that only
+	move forward (Last, Expires, activity) are merged with max regardless of
+	stamps, and version timelines are a union.
+*/
+
+type Stamp struct {
+	T       int64 `json:"t"` // unix nano
+	Deleted bool  `json:"deleted,omitempty"`
+}
+
+func StampKey(kind, uuid, host string) string {
+	return kind + ":" + uuid + "/" + host
+}
+
+func ParseStampKey(key string) (kind, uuid, host string) {
+	i := strings.Index(key, ":")
+	if i < 0 {
+		return "", "", ""
+	}
+	kind, rest := key[:i], key[i+1:]
+	j := strings.Index(rest, "/")
+	if j < 0 {
+		return kind, rest, ""
+	}
+	return kind, rest[:j], rest[j+1:]
+}
+
+// Touch stamps a local change. The caller must hold the lock.
+func (self *Library) Touch(kind, uuid, host string, deleted bool) {
+	if self.Stamps == nil {
+		self.Stamps = map[string]Stamp{}
+	}
+	key := StampKey(kind, uuid, host)
+	t := time.Now().UnixNano()
+	// Never go backwards, e.g. two changes within the clock's resolution
+	if prev, hasKey := self.Stamps[key]; hasKey && prev.T >= t {
+		t = prev.T + 1
+	}
+	self.Stamps[key] = Stamp{T: t, Deleted: deleted}
+}
+
+// CompactStamps forgets tombstones older than TOMBSTONE_TTL
+func (self *Library) CompactStamps(now time.Time) {
+	for key, stamp := range self.Stamps {
+		if stamp.Deleted && now.Sub(time.Unix(0, stamp.T)) > TOMBSTONE_TTL {
+			delete(self.Stamps, key)
+		}
+	}
+}
+
+// Merge folds a peer's library into this one, returns true if anything changed. The caller must hold the lock.
+func (self *Library) Merge(remote *Library) bool {
+
+	changed := false
+
+	keys := []string{}
+	for key, _ := range remote.Stamps {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ki, _, _ := ParseStampKey(keys[i])
+		kj, _, _ := ParseStampKey(keys[j])
+		if MERGE_ORDER[ki] != MERGE_ORDER[kj] {
+			return MERGE_ORDER[ki] < MERGE_ORDER[kj]
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, key := range keys {
+		rs := remote.Stamps[key]
+		if ls, hasKey := self.Stamps[key]; hasKey && ls.T >= rs.T {
+			continue
+		}
+		kind, uuid, host := ParseStampKey(key)
+		switch kind {
+		case STAMP_CHECKOUT:
+			if rs.Deleted {
+				if self.HasCheckout(uuid, host) {
+					delete(self.Projects[uuid].Checkouts, host)
+					self.Projects[uuid].ForgetActivity(host)
+					if len(self.Projects[uuid].Checkouts) == 0 {
+						delete(self.Projects, uuid)
+					}
+				}
+				break
+			}
+			rp, hasKey := remote.Projects[uuid]
+			if !hasKey || rp.Checkouts[host] == nil {
+				continue
+			}
+			if !self.HasProject(uuid) {
+				self.Projects[uuid] = &Project{
+					Name:      rp.Name,
+					Info:      rp.Info,
+					Events:    rp.Events,
+					Activity:  map[string]map[string]*EventActivity{},
+					Storage:   rp.Storage,
+					Versions:  rp.Versions,
+					Checkouts: map[string]*Checkout{},
+				}
+			}
+			chk := *rp.Checkouts[host]
+			self.Projects[uuid].Checkouts[host] = &chk
+		case STAMP_PROJECT:
+			rp, hasRemote := remote.Projects[uuid]
+			lp, hasLocal := self.Projects[uuid]
+			if !hasRemote || !hasLocal {
+				continue
+			}
+			lp.Name = rp.Name
+			lp.Info = rp.Info
+			lp.Events = rp.Events
+			lp.Storage = rp.Storage
+			lp.Versions = rp.Versions
+		case STAMP_RESERVATION:
+			if rs.Deleted {
+				delete(self.Reservations, uuid)
+				break
+			}
+			r, hasKey := remote.Reservations[uuid]
+			if !hasKey {
+				continue
+			}
+			copied := *r
+			self.Reservations[uuid] = &copied
+		case STAMP_SUBSCRIPTION:
+			if rs.Deleted {
+				self.Unsubscribe(uuid, host)
+			} else {
+				self.Subscribe(uuid, host)
+			}
+		default:
+			continue
+		}
+		self.Stamps[key] = rs
+		changed = true
+	}
+
+	for uuid, rp := range remote.Projects {
+		lp, hasKey := self.Projects[uuid]
+		if !hasKey {
+			continue
+		}
+		for host, rc := range rp.Checkouts {
+			lc, hasKey := lp.Checkouts[host]
+			if !hasKey {
+				continue
+			}
+			if rc.Last > lc.Last {
+				lc.Last = rc.Last
+				changed = true
+			}
+			if rc.Expires > lc.Expires {
+				lc.Expires = rc.Expires
+				changed = true
+			}
+			if lc.Unconfirmed && !rc.Unconfirmed {
+				lc.Unconfirmed = false
+				changed = true
+			}
+		}
+		for event, hosts := range rp.Activity {
+			for host, ra := range hosts {
+				// A peer that has yet to see the close would bring it back
+				if _, hasKey := lp.Checkouts[host]; !hasKey {
+					continue
+				}
+				if lp.Activity == nil {
+					lp.Activity = map[string]map[string]*EventActivity{}
+				}
+				if lp.Activity[event] == nil {
+					lp.Activity[event] = map[string]*EventActivity{}
+				}
+				la, hasKey := lp.Activity[event][host]
+				if !hasKey || ra.Last > la.Last {
+					copied := *ra
+					lp.Activity[event][host] = &copied
+					changed = true
+				}
+			}
+		}
+	}
+
+	for uuid, timeline := range remote.Timelines {
+		for _, ev := range timeline {
+			if self.hasVersionEvent(uuid, ev) {
+				continue
+			}
+			self.Timelines[uuid] = append(self.Timelines[uuid], ev)
+			sort.SliceStable(self.Timelines[uuid], func(i, j int) bool {
+				return self.Timelines[uuid][i].T < self.Timelines[uuid][j].T
+			})
+			changed = true
+		}
+	}
+
+	return changed
+
+}
+
+func (self *Library) hasVersionEvent(uuid string, ev VersionEvent) bool {
+	for _, v := range self.Timelines[uuid] {
+		if v.Folder == ev.Folder && v.Name == ev.Name && v.Size == ev.Size && v.Mtime == ev.Mtime {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeReplica applies a peer's snapshot and returns ours so one exchange is both a push and a pull
+func (self *Server) MergeReplica(b []byte) ([]byte, error) {
+	remote := NewLibrary()
+	err := json.Unmarshal(b, &remote)
+	if err != nil {
+		return nil, err
+	}
+	self.Library.Lock()
+	defer self.Library.Unlock()
+	if self.Library.Merge(&remote) {
+		self.ReconcileConflicts()
+		self.SaveLibrary()
+	}
+	return json.Marshal(&self.Library)
+}
+
+// Replicate exchanges snapshots with every peer server
+func (self *Server) Replicate() {
+	peers := self.Peers.MemberList()
+	if len(peers) == 0 {
+		return
+	}
+	self.Library.Lock()
+	b, err := json.Marshal(&self.Library)
+	self.Library.Unlock()
+	if err != nil {
+		LogError("[REPLICATE] " + err.Error())
+		return
+	}
+	for hostname, url := range peers {
+		self.send(hostname, url, "_replicate", b, func(peer string, body []byte) {
+			_, err := self.MergeReplica(body)
+			if err != nil {
+				LogError("[REPLICATE] [" + peer + "] " + err.Error())
+			}
+		})
+	}
+}
+
+// MarkDirty schedules a replication, never blocks
+func (self *Server) MarkDirty() {
+	select {
+	case self.ReplicateChan <- true:
+	default:
+	}
+}
+
+// ReplicateDirty replicates if anything changed since the last call, every REPLICATE_INTERVAL
+func (self *Server) ReplicateDirty() {
+	select {
+	case <-self.ReplicateChan:
+		self.Replicate()
+	default:
+	}
+}
+
+// IsSender elects the server that notifies clients, the lowest hostname among
+// the reachable peers, so the replicas of an HA pair don't all notify
+func (self *Server) IsSender() bool {
+	for hostname, _ := range self.Peers.MemberList() {
+		if hostname >= self.Hostname {
+			continue
+		}
+		if _, _, awol := self.Health(hostname); !awol {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *Server) POST_Replicate(c *gin.Context) {
+	b, err := c.GetRawData()
+	if err != nil {
+		JSONError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	res, err := self.MergeReplica(b)
+	if err != nil {
+		JSONError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	c.Data(200, "application/json", res)
+}
+
+func (self *Server) GET_Peers(c *gin.Context) {
+	c.JSON(200, self.Peers.MemberList())
+}
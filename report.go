@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	REPORT_JSON = "json"
+	REPORT_CSV  = "csv"
+
+	DEFAULT_REPORT_RANGE = 7 * 24 * time.Hour
+)
+
+// UsageRow totals one library on one host, or one library on every host when Hostname is empty
+type UsageRow struct {
+	UUID      string  `json:"uuid"`
+	Name      string  `json:"name"`
+	Hostname  string  `json:"hostname,omitempty"`
+	Checkouts int     `json:"checkouts"` // Intervals overlapping the range
+	Open      int64   `json:"open"`      // seconds the library was checked out
+	Updates   int     `json:"updates"`   // update events, at most one per historyUpdateInterval
+	Active    int64   `json:"active"`    // seconds, Updates * historyUpdateInterval
+	Hours     float64 `json:"hours"`     // Open in hours
+}
+
+type UsageReport struct {
+	Since    int64      `json:"since"`
+	Until    int64      `json:"until"`
+	Rows     []UsageRow `json:"rows"`     // per project and host
+	Projects []UsageRow `json:"projects"` // per project
+}
+
+// BuildUsageReport replays history into checkout intervals. An interval opens
+// with a checkout and ends with a close, expiry or forced release of the same
+// library on the same host. Intervals still open are counted up to `until`.
+// Only the part of each interval inside [since, until] counts.
+func BuildUsageReport(events []HistoryEvent, since, until int64) UsageReport {
+
+	sorted := make([]HistoryEvent, len(events))
+	copy(sorted, events)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].T < sorted[j].T
+	})
+
+	rows := map[string]*UsageRow{}
+	row := func(ev HistoryEvent) *UsageRow {
+		key := ev.UUID + "/" + ev.Hostname
+		r, hasKey := rows[key]
+		if !hasKey {
+			r = &UsageRow{UUID: ev.UUID, Hostname: ev.Hostname}
+			rows[key] = r
+		}
+		if ev.Name != "" {
+			r.Name = ev.Name
+		}
+		return r
+	}
+	clip := func(r *UsageRow, start, end int64) {
+		if start < since {
+			start = since
+		}
+		if end > until {
+			end = until
+		}
+		if end > start {
+			r.Open += end - start
+			r.Checkouts += 1
+		}
+	}
+
+	opened := map[string]int64{} // uuid/host -> start
+	for _, ev := range sorted {
+		if ev.T > until {
+			break
+		}
+		key := ev.UUID + "/" + ev.Hostname
+		switch ev.Kind {
+		case EVENT_CHECKOUT:
+			row(ev)
+			if _, hasKey := opened[key]; !hasKey {
+				opened[key] = ev.T
+			}
+		case EVENT_CLOSE, EVENT_EXPIRED, EVENT_RELEASED:
+			r := row(ev)
+			start, hasKey := opened[key]
+			if hasKey {
+				clip(r, start, ev.T)
+				delete(opened, key)
+			}
+		case EVENT_UPDATE:
+			r := row(ev)
+			if ev.T >= since {
+				r.Updates += 1
+				r.Active += historyUpdateInterval
+			}
+		}
+	}
+	for key, start := range opened {
+		clip(rows[key], start, until)
+	}
+
+	report := UsageReport{Since: since, Until: until, Rows: []UsageRow{}, Projects: []UsageRow{}}
+	projects := map[string]*UsageRow{}
+	for _, r := range rows {
+		if r.Checkouts == 0 && r.Updates == 0 {
+			continue
+		}
+		r.Hours = hours(r.Open)
+		report.Rows = append(report.Rows, *r)
+		p, hasKey := projects[r.UUID]
+		if !hasKey {
+			p = &UsageRow{UUID: r.UUID, Name: r.Name}
+			projects[r.UUID] = p
+		}
+		p.Checkouts += r.Checkouts
+		p.Open += r.Open
+		p.Updates += r.Updates
+		p.Active += r.Active
+	}
+	for _, p := range projects {
+		p.Hours = hours(p.Open)
+		report.Projects = append(report.Projects, *p)
+	}
+	sortUsage(report.Rows)
+	sortUsage(report.Projects)
+	return report
+
+}
+
+func hours(seconds int64) float64 {
+	return math.Round(float64(seconds)/36) / 100
+}
+
+func sortUsage(rows []UsageRow) {
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Name != rows[j].Name {
+			return rows[i].Name < rows[j].Name
+		}
+		if rows[i].UUID != rows[j].UUID {
+			return rows[i].UUID < rows[j].UUID
+		}
+		return rows[i].Hostname < rows[j].Hostname
+	})
+}
+
+// CSV writes one line per project and host
+func (self UsageReport) CSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"project", "uuid", "hostname", "checkouts", "open_hours", "active_hours", "updates", "since", "until"})
+	since := time.Unix(self.Since, 0).Format(time.RFC3339)
+	until := time.Unix(self.Until, 0).Format(time.RFC3339)
+	for _, r := range self.Rows {
+		cw.Write([]string{
+			r.Name,
+			r.UUID,
+			r.Hostname,
+			strconv.Itoa(r.Checkouts),
+			fmt.Sprintf("%.2f", float64(r.Open)/3600),
+			fmt.Sprintf("%.2f", float64(r.Active)/3600),
+			strconv.Itoa(r.Updates),
+			since,
+			until,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReportRange parses since/until, defaulting to the last DEFAULT_REPORT_RANGE
+func ReportRange(sinceArg, untilArg string) (int64, int64, error) {
+	since, err := ParseTime(sinceArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	until, err := ParseTime(untilArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	if until == 0 {
+		until = time.Now().Unix()
+	}
+	if since == 0 {
+		since = until - int64(DEFAULT_REPORT_RANGE.Seconds())
+	}
+	return since, until, nil
+}
+
+func WriteUsageReport(w io.Writer, report UsageReport, format string) error {
+	switch format {
+	case REPORT_CSV:
+		return report.CSV(w)
+	case REPORT_JSON, "":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return errors.New("Invalid format: " + format)
+}
+
+func (self *Server) GET_Report(c *gin.Context) {
+	since, until, err := ReportRange(c.Query("since"), c.Query("until"))
+	if err != nil {
+		JSONError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter := HistoryFilter{UUID: c.Query("uuid"), Hostname: c.Query("hostname"), Until: until}
+	report := BuildUsageReport(self.History.Query(filter), since, until)
+	switch c.DefaultQuery("format", REPORT_JSON) {
+	case REPORT_CSV:
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s.csv"`, time.Unix(since, 0).Format("2006-01-02")))
+		c.Header("Content-Type", "text/csv")
+		c.Status(200)
+		report.CSV(c.Writer)
+	case REPORT_JSON:
+		c.JSON(200, report)
+	default:
+		JSONError(c, http.StatusBadRequest, "Invalid format: "+c.Query("format"))
+	}
+}
+
+// RunReport is the `report` mode, it reads the history file of a server directly
+func RunReport(historyPath, sinceArg, untilArg, format string) error {
+	since, until, err := ReportRange(sinceArg, untilArg)
+	if err != nil {
+		return err
+	}
+	history := NewHistory(historyPath)
+	err = history.Load()
+	if err != nil {
+		return err
+	}
+	report := BuildUsageReport(history.Query(HistoryFilter{Until: until}), since, until)
+	return WriteUsageReport(os.Stdout, report, format)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EVENT_RESERVE  = "reserve"
+	EVENT_RELEASE  = "release"
+	EVENT_REJECTED = "rejected"
+)
+
+type Reservation struct {
+	UUID     string `json:"uuid"`
+	Hostname string `json:"hostname"` // The only host allowed to open the library
+	By       string `json:"by"`       // Who asked for it e.g. a producer
+	Note     string `json:"note"`
+	T        int64  `json:"t"`
+}
+
+type Rejection struct {
+	UUID   string `json:"uuid"`
+	Status int    `json:"status"`
+	Holder string `json:"holder"`
+	Error  string `json:"error"`
+}
+
+func (self *Library) Reserve(r Reservation) (int, error) {
+	if r.UUID == "" || r.Hostname == "" {
+		return http.StatusBadRequest, errors.New("Reservation needs a uuid and hostname")
+	}
+	current, hasKey := self.Reservations[r.UUID]
+	if hasKey && current.Hostname != r.Hostname {
+		return http.StatusConflict, errors.New(fmt.Sprintf("Library %s is reserved by %s", r.UUID, current.Hostname))
+	}
+	if r.T == 0 {
+		r.T = time.Now().Unix()
+	}
+	self.Reservations[r.UUID] = &r
+	self.Touch(STAMP_RESERVATION, r.UUID, "", false)
+	return 0, nil
+}
+
+func (self *Library) Release(uuid string) (int, error) {
+	_, hasKey := self.Reservations[uuid]
+	if !hasKey {
+		return http.StatusNotFound, errors.New("No reservation for: " + uuid)
+	}
+	delete(self.Reservations, uuid)
+	self.Touch(STAMP_RESERVATION, uuid, "", true)
+	return 0, nil
+}
+
+// ReservedFor returns the reservation on `uuid` if it belongs to a host other than `host`
+func (self *Library) ReservedFor(uuid, host string) (*Reservation, bool) {
+	r, hasKey := self.Reservations[uuid]
+	if !hasKey || r.Hostname == host {
+		return nil, false
+	}
+	return r, true
+}
+
+func NewNotices() Notices {
+	return Notices{Sent: map[string]bool{}}
+}
+
+// Notices remembers which notifications went out so repeated reports don't spam anyone
+type Notices struct {
+	sync.Mutex
+	Sent map[string]bool
+}
+
+// Once returns true the first time it sees `key`
+func (self *Notices) Once(key string) bool {
+	self.Lock()
+	defer self.Unlock()
+	if self.Sent[key] {
+		return false
+	}
+	self.Sent[key] = true
+	return true
+}
+
+// Retain forgets every key starting with `prefix` that isn't in `keep`
+func (self *Notices) Retain(prefix string, keep map[string]bool) {
+	self.Lock()
+	defer self.Unlock()
+	for key, _ := range self.Sent {
+		if strings.HasPrefix(key, prefix) && !keep[key] {
+			delete(self.Sent, key)
+		}
+	}
+}
+
+func (self *Server) Notify(hostname, message string) {
+	if !self.IsSender() {
+		return
+	}
+	b, _ := json.Marshal(NotifyMessage{message})
+	err := self.Send(hostname, "notify", b, CBTODO)
+	if err != nil {
+		LogError("[NOTIFY] " + err.Error())
+	}
+}
+
+func (self *Server) GET_Reservations(c *gin.Context) {
+	self.Library.Lock()
+	defer self.Library.Unlock()
+	c.JSON(http.StatusOK, gin.H{"reservations": self.Library.Reservations})
+}
+
+func (self *Server) POST_Reservation(c *gin.Context) {
+
+	r := Reservation{}
+	err := json.NewDecoder(c.Request.Body).Decode(&r)
+	if err != nil {
+		JSONError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	r.T = 0
+
+	self.Library.Lock()
+	defer self.Library.Unlock()
+
+	status, err := self.Library.Reserve(r)
+	if err != nil {
+		JSONError(c, status, err.Error())
+		return
+	}
+
+	self.SaveLibrary()
+	self.Record(EVENT_RESERVE, r.UUID, "", r.Hostname, r.By)
+	log.Printf("🔒 [%s] reserved for %s by %s", r.UUID, r.Hostname, r.By)
+
+	c.JSON(http.StatusOK, self.Library.Reservations[r.UUID])
+
+}
+
+func (self *Server) DELETE_Reservation(c *gin.Context) {
+
+	uuid := c.Param("uuid")
+
+	self.Library.Lock()
+	defer self.Library.Unlock()
+
+	r, hasKey := self.Library.Reservations[uuid]
+	status, err := self.Library.Release(uuid)
+	if err != nil {
+		JSONError(c, status, err.Error())
+		return
+	}
+
+	self.SaveLibrary()
+	if hasKey {
+		self.Record(EVENT_RELEASE, uuid, "", r.Hostname, "")
+	}
+	log.Printf("🔓 [%s] released", uuid)
+
+	c.JSON(http.StatusOK, gin.H{"ok": uuid})
+
+}
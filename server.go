@@ -2,12 +2,10 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"path/filepath"
-	"strconv"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -20,25 +18,45 @@ func NewServer(service Service) Server {
 	cl.Port = service.Port
 	cl.Service = service
 	cl.Library = NewLibrary()
-	cl.BroadcastChan = make(chan NotifyMessage)
+	cl.StorePath = filepath.Join(cl.DataDir, LIBRARY_STORE)
+	cl.History = NewHistory(filepath.Join(cl.DataDir, HISTORY_STORE))
+	cl.Notices = NewNotices()
+	cl.Conflicts = map[string]Conflict{}
+	cl.AFK = NewAFK()
+	cl.Broker = NewBroker()
+	cl.KnownMembers = map[string]bool{}
+	cl.Groups = Groups{}
+	cl.Inbox = NewInbox(filepath.Join(cl.DataDir, INBOX_STORE))
+	cl.Sessions = NewSessions(DEFAULT_SESSION_IDLE)
+	cl.Peers = NewService(service.Hostname, service.Port, SERVICE_SERVER, nil)
+	cl.ReplicateChan = make(chan bool, 1)
 	return cl
 }
 
-type AFK struct {
-	sync.Mutex
-	Map map[string]int
-}
-
 type Server struct {
 	Host
 	Library       Library
-	BroadcastChan chan NotifyMessage
+	StorePath     string
+	History       *History
+	Notices       Notices
+	Conflicts     map[string]Conflict
+	AFK           AFK
+	Broker        *Broker
+	KnownMembers  map[string]bool
+	Groups        Groups
+	Inbox         *Inbox
+	Sessions      *Sessions
+	Webhooks      *Webhooks // nil without --webhooks
+	Peers         Service   // Other servers, see replication.go
+	ReplicateChan chan bool
+	Unsaved       bool // Guarded by the library lock, see DeferSave
 }
 
 type CheckoutResponse struct {
-	Checkouts []string `json:"checkouts"`
-	Closed    []string `json:"closed"`
-	Errors    []string `json:"errors"`
+	Checkouts []string    `json:"checkouts"`
+	Closed    []string    `json:"closed"`
+	Errors    []string    `json:"errors"`
+	Rejected  []Rejection `json:"rejected"`
 }
 
 func NewCheckout() CheckoutResponse {
@@ -46,37 +64,67 @@ func NewCheckout() CheckoutResponse {
 		Checkouts: []string{},
 		Closed:    []string{},
 		Errors:    []string{},
+		Rejected:  []Rejection{},
 	}
 }
 
 func (self *Server) Start() error {
 
+	self.LoadLibrary()
+
+	err := self.History.Load()
+	if err != nil {
+		LogError("[HISTORY] " + err.Error())
+	}
+
+	err = self.Inbox.Load()
+	if err != nil {
+		LogError("[INBOX] " + err.Error())
+	}
+
+	go self.Peers.DiscoverPeers()
+
 	go func(ctx context.Context) {
+		ticker_1 := time.Tick(1 * time.Minute)
 		ticker_5 := time.Tick(5 * time.Minute)
+		ticker_replicate := time.Tick(REPLICATE_INTERVAL)
 	mLoop:
 		for {
 			select {
 			case <-ctx.Done():
 				break mLoop
-			case m := <-self.BroadcastChan:
-				b, _ := json.Marshal(m)
-				self.Broadcast("notify", b, CBTODO)
+			case <-ticker_1:
+				self.ExpireLeases()
+				self.DiffMembers()
+				self.SweepSessions()
+				self.SweepPresence()
+				self.Replicate()
+				self.FlushLibrary()
 			case <-ticker_5:
 				self.CheckMembersAlive()
 			case <-self.Service.BroadcastChan:
-				// No use server-side for now
+				// Every time there are add/drops to the services list e.g. clients
+				self.DiffMembers()
+			case <-self.Peers.BroadcastChan:
+				// A server joined, catch it up (or catch up with it)
+				self.Replicate()
+			case <-ticker_replicate:
+				self.ReplicateDirty()
 			}
 		}
 	}(self.Ctx)
 
-	return self.Listen()
+	err = self.Listen()
+
+	self.RecordSessions(self.Sessions.EndHost("", time.Now().Unix(), SESSION_SHUTDOWN))
+	self.FlushLibrary()
+
+	return err
 
 }
 
 func (self *Server) Listen() error {
 
-	afks := AFK{Map: map[string]int{}}
-
 	r := self.Router
 
 	r.GET("/", func(c *gin.Context) {
@@ -98,33 +146,79 @@ func (self *Server) Listen() error {
 		c.JSON(200, self.Library)
 	})
 
+	r.GET("/library/:uuid/storage", self.GET_Storage)
+
+	r.GET("/library/:uuid/versions", self.GET_Versions)
+
+	r.GET("/subscriptions", self.GET_Subscriptions)
+
+	r.POST("/subscriptions", Signed, self.POST_Subscription)
+
+	r.DELETE("/subscriptions/:uuid/:hostname", Signed, self.DELETE_Subscription)
+
+	r.GET("/projects", self.GET_Projects)
+
+	r.GET("/projects/:uuid", self.GET_Project)
+
+	r.DELETE("/projects/:uuid/checkouts/:host", Signed, self.DELETE_ProjectCheckout)
+
+	r.GET("/hosts", self.GET_Hosts)
+
+	r.GET("/hosts/:hostname", self.GET_Host)
+
+	r.GET("/history", self.GET_History)
+
+	r.GET("/report", self.GET_Report)
+
+	r.GET("/timesheet", self.GET_Timesheet)
+
+	r.GET("/sessions", self.GET_Sessions)
+
+	r.GET("/calendar.ics", self.GET_Calendar)
+
+	r.GET("/events", self.GET_Events)
+
+	r.GET("/reservations", self.GET_Reservations)
+
+	r.POST("/reservations", Signed, self.POST_Reservation)
+
+	r.DELETE("/reservations/:uuid", Signed, self.DELETE_Reservation)
+
+	r.GET("/conflicts", self.GET_Conflicts)
+
+	r.GET("/metrics", self.GET_Metrics)
+
+	r.GET("/peers", self.GET_Peers)
+
+	r.GET("/webhooks", self.GET_Webhooks)
+
 	r.GET("/members", func(c *gin.Context) {
-		c.JSON(200, self.Service.Members)
+		c.JSON(200, self.Service.MemberList())
 	})
 
-	r.POST("/broadcast", func(c *gin.Context) {
-		m := NotifyMessage{}
-		json.NewDecoder(c.Request.Body).Decode(&m)
-		self.BroadcastChan <- m
-		c.JSON(200, gin.H{"receivers": self.Service.Members})
-	})
+	r.POST("/broadcast", Signed, self.POST_Broadcast)
 
-	r.GET("/afks", func(c *gin.Context) {
-		c.JSON(200, afks.Map)
-	})
+	r.GET("/groups", self.GET_Groups)
 
-	r.HEAD("/_afk/:hostname/:secondsaway", func(c *gin.Context) {
-		hostname := c.Param("hostname")
-		secondsaway, _ := strconv.Atoi(c.Param("secondsaway"))
-		afks.Lock()
-		defer afks.Unlock()
-		afks.Map[hostname] = secondsaway
-		c.String(200, "ok")
-	})
+	r.GET("/messages", self.GET_Messages)
+
+	r.GET("/afks", self.GET_AFKs)
+
+	r.GET("/afks/history", self.GET_AFKHistory)
+
+	r.GET("/_afk/:hostname/:secondsaway", Signed, self.GET_AFK)
+
+	r.POST("/_checkout", Signed, self.POST_Checkout)
+
+	r.POST("/_update", Signed, self.POST_Update)
 
-	r.POST("/_checkout", self.POST_Checkout)
+	r.POST("/_deliverable", Signed, self.POST_Deliverable)
 
-	r.POST("/_update", self.POST_Update)
+	r.POST("/_replicate", Signed, self.POST_Replicate)
+
+	r.GET("/_inbox/:hostname", Signed, self.GET_Inbox)
+
+	r.POST("/_inbox/:hostname/ack", Signed, self.POST_InboxAck)
 
 	r.GET("/_legs", func(c *gin.Context) {
 		// k := Kobako["abby.jpg"]
@@ -135,7 +229,7 @@ func (self *Server) Listen() error {
 
 	log.Printf("😎 server started: %s :%d [%s]", self.Hostname, self.Port, self.Service.TXTRecord["version"])
 
-	go r.Run(fmt.Sprintf(":%d", self.Port))
+	go self.Run()
 
 	<-self.Ctx.Done()
 
@@ -151,18 +245,61 @@ func (self *Server) Checkout(cl ClientPayload) CheckoutResponse {
 	checkout := NewCheckout()
 
 	uuids := map[string]bool{}
+	noticePrefix := fmt.Sprintf("reserved:%s:", cl.Hostname)
+	notices := map[string]bool{}
 
 	for uuid, lib := range cl.Libraries {
+		r, isReserved := self.Library.ReservedFor(uuid, cl.Hostname)
+		if isReserved {
+			// The library is still open on the host, so a checkout from before
+			// the reservation is kept until it really closes
+			if self.Library.HasCheckout(uuid, cl.Hostname) {
+				chk := self.Library.Projects[uuid].Checkouts[cl.Hostname]
+				chk.Expires = self.Library.Lease()
+				chk.Unconfirmed = false
+				uuids[uuid] = true
+			}
+			msg := fmt.Sprintf("Library '%s' is reserved by %s", lib.Name, r.Hostname)
+			checkout.Rejected = append(checkout.Rejected, Rejection{
+				UUID:   uuid,
+				Status: http.StatusConflict,
+				Holder: r.Hostname,
+				Error:  msg,
+			})
+			key := noticePrefix + uuid
+			notices[key] = true
+			if self.Notices.Once(key) {
+				LogWarning(fmt.Sprintf("[%s] %s", cl.Hostname, msg))
+				self.Record(EVENT_REJECTED, uuid, lib.Name, cl.Hostname, r.Hostname)
+				go self.Notify(cl.Hostname, fmt.Sprintf("⛔️ %s. Please close it.", msg))
+			}
+			continue
+		}
+		isNew := !self.Library.HasCheckout(uuid, cl.Hostname)
 		err := self.Library.CheckoutProject(uuid, lib.Name, cl.Hostname, lib.Path, lib.Info)
+		if isNew {
+			self.Record(EVENT_CHECKOUT, uuid, lib.Name, cl.Hostname, lib.Path)
+		}
+		self.Library.SetMetadata(uuid, lib)
 		if err != nil {
 			checkout.Errors = append(checkout.Errors, uuid)
 			LogError(fmt.Sprintf("[%s] %s", cl.Hostname, err.Error()))
+			if isNew {
+				self.Record(EVENT_CONFLICT, uuid, lib.Name, cl.Hostname, err.Error())
+			}
 		} else {
 			checkout.Checkouts = append(checkout.Checkouts, uuid)
 		}
 		uuids[uuid] = true
 	}
 
+	self.Notices.Retain(noticePrefix, notices)
+
+	names := map[string]string{}
+	for uuid, project := range self.Library.Projects {
+		names[uuid] = project.Name
+	}
+
 	if len(checkout.Checkouts) > 0 {
 		for _, uuid := range checkout.Checkouts {
 			log.Printf("✅ [%s] by %s", uuid, cl.Hostname)
@@ -172,6 +309,13 @@ func (self *Server) Checkout(cl ClientPayload) CheckoutResponse {
 	closed, removed := self.Library.DeregisterProjects(cl.Hostname, uuids)
 	checkout.Closed = closed
 
+	for _, uuid := range closed {
+		self.Record(EVENT_CLOSE, uuid, names[uuid], cl.Hostname, "")
+	}
+	for _, uuid := range removed {
+		self.Record(EVENT_REMOVE, uuid, names[uuid], cl.Hostname, "")
+	}
+
 	// Print what was removed/closed
 	if len(closed) > 0 || len(removed) > 0 {
 		for stat, dd := range map[string][]string{"CLOSED": closed, "REMOVED": removed} {
@@ -181,6 +325,9 @@ func (self *Server) Checkout(cl ClientPayload) CheckoutResponse {
 		}
 	}
 
+	self.ReconcileConflicts()
+	self.SaveLibrary()
+
 	return checkout
 
 }
@@ -14,14 +14,14 @@ func (self *Server) POST_Checkout(c *gin.Context) {
 	b, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
 		LogError(err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		JSONError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	cl, err := ClientFromJSON(b)
 	if err != nil {
 		LogError(err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		JSONError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -36,19 +36,84 @@ func (self *Server) POST_Update(c *gin.Context) {
 	err := json.NewDecoder(c.Request.Body).Decode(&update)
 	if err != nil {
 		LogError(err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		JSONError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	self.Library.Lock()
 	defer self.Library.Unlock()
 
+	prev := int64(0)
+	if self.Library.HasCheckout(update.UUID, update.Hostname) {
+		prev = self.Library.Projects[update.UUID].Checkouts[update.Hostname].Last
+	}
+
 	status, err := self.Library.Update(update)
 	if err != nil {
-		c.JSON(status, gin.H{"error": err.Error()})
+		JSONError(c, status, err.Error())
+		return
+	}
+
+	name := self.Library.Projects[update.UUID].Name
+	if update.Background() {
+		// Renders at 3 a.m. are neither time spent nor an edit worth a history entry
+		self.Publish(EVENT_UPDATE, update.UUID, name, update.Hostname, update.Event)
+		self.DeferSave()
+		c.JSON(200, gin.H{"ok": fmt.Sprintf("%d", update.Last)})
 		return
 	}
 
+	self.RecordSessions(self.Sessions.Activity(update.Hostname, update.UUID, name, update.Last))
+	if update.Last-prev >= historyUpdateInterval {
+		self.Record(EVENT_UPDATE, update.UUID, name, update.Hostname, update.Event)
+	} else {
+		self.Publish(EVENT_UPDATE, update.UUID, name, update.Hostname, update.Event)
+	}
+
+	self.DeferSave()
+
 	c.JSON(200, gin.H{"ok": fmt.Sprintf("%d", update.Last)})
 
 }
+
+func (self *Server) GET_History(c *gin.Context) {
+
+	filter := HistoryFilter{
+		UUID:     c.Query("uuid"),
+		Hostname: c.Query("hostname"),
+		Kind:     c.Query("kind"),
+	}
+
+	var err error
+	for param, t := range map[string]*int64{"since": &filter.Since, "until": &filter.Until} {
+		*t, err = ParseTime(c.Query(param))
+		if err != nil {
+			JSONError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"history": self.History.Query(filter)})
+
+}
+
+func (self *Server) GET_Storage(c *gin.Context) {
+
+	uuid := c.Param("uuid")
+
+	self.Library.Lock()
+	defer self.Library.Unlock()
+
+	project, hasKey := self.Library.Projects[uuid]
+	if !hasKey {
+		JSONError(c, http.StatusNotFound, "Project does not exist: "+uuid)
+		return
+	}
+	if project.Storage == nil {
+		JSONError(c, http.StatusNotFound, "Storage not scanned yet: "+uuid)
+		return
+	}
+
+	c.JSON(http.StatusOK, project.Storage)
+
+}
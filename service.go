@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
 	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 
 	"github.com/grandcat/zeroconf"
 )
@@ -16,6 +19,10 @@ const (
 
 type StringMap map[string]string
 
+// membersLock guards Members and Records of every Service, they're written by
+// discovery and Host.Remove while broadcasts and handlers read them
+var membersLock sync.RWMutex
+
 func NewService(hostname string, port int, serviceName string, _txtrecord *StringMap) Service {
 	txtrecord := map[string]string{}
 	if _txtrecord != nil {
@@ -27,6 +34,7 @@ func NewService(hostname string, port int, serviceName string, _txtrecord *Strin
 		Name:          serviceName,
 		TXTRecord:     txtrecord,
 		Members:       StringMap{},
+		Records:       map[string]StringMap{},
 		BroadcastChan: make(chan StringMap, 100), // Have a buffer so we can test without having a consumer
 		ExitChan:      make(chan bool),
 	}
@@ -38,8 +46,10 @@ type Service struct {
 	Name          string
 	TXTRecord     map[string]string
 	Members       map[string]string
+	Records       map[string]StringMap // TXT record of each member
 	BroadcastChan chan StringMap
 	ExitChan      chan bool
+	IgnoreSelf    bool // Discovering our own kind, see DiscoverPeers
 }
 
 func (self *Service) Stop() {
@@ -55,6 +65,12 @@ func (self *Service) Start() {
 	self.broadcast()
 }
 
+// DiscoverPeers finds other services of our own kind e.g. the other servers
+func (self *Service) DiscoverPeers() {
+	self.IgnoreSelf = true
+	self.discover(self.Name)
+}
+
 /*
 type ServiceEntry struct {
 	ServiceRecord
@@ -69,15 +85,36 @@ type ServiceEntry struct {
 
 func (self *Service) callback(entry *zeroconf.ServiceEntry) error {
 	hostname := entry.ServiceRecord.Instance
+	if self.IgnoreSelf && hostname == self.Hostname {
+		return nil
+	}
+	record := ParseTXTRecord(entry.Text)
+	// Peers that advertise a certificate are only reached over https, pinned to it
+	scheme, fp := "http", record["fp"]
+	err := knownHosts.CheckPeer(hostname, fp, nodeCertificate != nil)
+	if err != nil {
+		return err
+	}
+	if fp != "" {
+		scheme = "https"
+	}
 	okURLs := []string{}
 	for _, ip := range entry.AddrIPv4 {
-		url := fmt.Sprintf("http://%s:%d", ip.String(), entry.Port)
-		c := NewHTTPTimeoutClient()
-		res, err := c.Head(fmt.Sprintf("%s/_ping", url))
+		url := fmt.Sprintf("%s://%s:%d", scheme, ip.String(), entry.Port)
+		c := NewPinnedClient(fp)
+		req, err := NewSignedRequest("HEAD", fmt.Sprintf("%s/_ping", url), NOBODY)
+		if err != nil {
+			return err
+		}
+		challenge := NewNonce()
+		req.Header.Set(HEADER_CHALLENGE, challenge)
+		res, err := c.Do(req)
 		if err != nil {
 			return err
 		} else if res.StatusCode != 200 {
 			return errors.New(fmt.Sprintf("Received status code: %d from '%s'", res.StatusCode, url))
+		} else if len(teamSecret) > 0 && !hmac.Equal([]byte(res.Header.Get(HEADER_PROOF)), []byte(Proof(challenge, hostname, entry.Port))) {
+			return errors.New(fmt.Sprintf("Peer doesn't know the team secret or isn't '%s' (%s)", hostname, url))
 		} else {
 			okURLs = append(okURLs, url)
 		}
@@ -85,13 +122,72 @@ func (self *Service) callback(entry *zeroconf.ServiceEntry) error {
 	if len(okURLs) == 0 {
 		return errors.New("No valid ips found for host: " + hostname)
 	}
-	self.Members[hostname] = okURLs[0]
+	if fp != "" {
+		err := knownHosts.Pin(hostname, fp)
+		if err != nil {
+			LogError("[SERVICE] " + err.Error())
+		}
+	}
+	self.SetMember(hostname, okURLs[0], record)
 	if self.BroadcastChan != nil { // There might be cases when you don't care about this, so you can `nil` it out
-		self.BroadcastChan <- self.Members
+		self.BroadcastChan <- self.MemberList()
 	}
 	return nil
 }
 
+func (self *Service) SetMember(hostname, url string, record StringMap) {
+	membersLock.Lock()
+	defer membersLock.Unlock()
+	self.Members[hostname] = url
+	if self.Records == nil {
+		self.Records = map[string]StringMap{}
+	}
+	self.Records[hostname] = record
+}
+
+func (self *Service) RemoveMember(hostname string) {
+	membersLock.Lock()
+	defer membersLock.Unlock()
+	delete(self.Members, hostname)
+	delete(self.Records, hostname)
+}
+
+func (self *Service) Member(hostname string) (string, bool) {
+	membersLock.RLock()
+	defer membersLock.RUnlock()
+	url, hasKey := self.Members[hostname]
+	return url, hasKey
+}
+
+// MemberRecord is the TXT record of a member, nil if it isn't one
+func (self *Service) MemberRecord(hostname string) StringMap {
+	membersLock.RLock()
+	defer membersLock.RUnlock()
+	return self.Records[hostname]
+}
+
+// MemberList is a copy of Members that is safe to range over
+func (self *Service) MemberList() StringMap {
+	membersLock.RLock()
+	defer membersLock.RUnlock()
+	members := StringMap{}
+	for hostname, url := range self.Members {
+		members[hostname] = url
+	}
+	return members
+}
+
+func ParseTXTRecord(text []string) StringMap {
+	record := StringMap{}
+	for _, kv := range text {
+		i := strings.Index(kv, "=")
+		if i > 0 {
+			record[kv[:i]] = kv[i+1:]
+		}
+	}
+	return record
+}
+
 func (self *Service) broadcast() {
 
 	txtRecord := []string{}
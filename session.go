@@ -0,0 +1,277 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EVENT_SESSION = "session"
+
+	DEFAULT_SESSION_IDLE = 10 * time.Minute
+
+	SESSION_IDLE     = "idle"     // No activity, or the host reported being AFK, for longer than the threshold
+	SESSION_CLOSED   = "closed"   // The library was closed, expired or released
+	SESSION_LOST     = "lost"     // The host left the network
+	SESSION_SHUTDOWN = "shutdown" // The server stopped
+)
+
+// Session is one stretch of editing on one library by one host
+type Session struct {
+	Hostname string `json:"hostname"`
+	UUID     string `json:"uuid"`
+	Name     string `json:"name"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`  // 0 while open
+	Last     int64  `json:"last"` // Last activity
+	Updates  int    `json:"updates"`
+	Reason   string `json:"reason,omitempty"` // See SESSION_*
+}
+
+// Duration is up to `now` for open sessions
+func (self Session) Duration(now int64) int64 {
+	if self.End == 0 {
+		return now - self.Start
+	}
+	return self.End - self.Start
+}
+
+func NewSessions(idle time.Duration) *Sessions {
+	return &Sessions{Idle: idle, Open: map[string]*Session{}}
+}
+
+// Sessions tracks the open session of every host and library
+type Sessions struct {
+	sync.Mutex
+	Idle time.Duration
+	Open map[string]*Session // hostname/uuid
+}
+
+func (self *Sessions) threshold() int64 {
+	if self.Idle == 0 {
+		return int64(DEFAULT_SESSION_IDLE.Seconds())
+	}
+	return int64(self.Idle.Seconds())
+}
+
+// end closes a session at `at`, but never before its last activity nor more
+// than the idle threshold after it. The caller must hold the lock.
+func (self *Sessions) end(key string, at int64, reason string) Session {
+	s := self.Open[key]
+	delete(self.Open, key)
+	end := at
+	if end > s.Last+self.threshold() {
+		end = s.Last + self.threshold()
+	}
+	if end < s.Last {
+		end = s.Last
+	}
+	s.End = end
+	s.Reason = reason
+	return *s
+}
+
+// Activity extends the open session, or opens one. A gap longer than the
+// threshold ends the previous session first.
+func (self *Sessions) Activity(hostname, uuid, name string, t int64) (ended []Session) {
+	self.Lock()
+	defer self.Unlock()
+	ended = []Session{}
+	key := hostname + "/" + uuid
+	s, hasKey := self.Open[key]
+	if hasKey && t-s.Last > self.threshold() {
+		ended = append(ended, self.end(key, s.Last, SESSION_IDLE))
+		hasKey = false
+	}
+	if !hasKey {
+		s = &Session{Hostname: hostname, UUID: uuid, Name: name, Start: t, Last: t}
+		self.Open[key] = s
+	}
+	if t > s.Last {
+		s.Last = t
+	}
+	s.Updates += 1
+	return ended
+}
+
+// End closes the session of a host on a library, if any
+func (self *Sessions) End(hostname, uuid string, at int64, reason string) []Session {
+	self.Lock()
+	defer self.Unlock()
+	key := hostname + "/" + uuid
+	if _, hasKey := self.Open[key]; !hasKey {
+		return []Session{}
+	}
+	return []Session{self.end(key, at, reason)}
+}
+
+// EndHost closes every session of a host, or of every host if hostname is empty
+func (self *Sessions) EndHost(hostname string, at int64, reason string) []Session {
+	self.Lock()
+	defer self.Unlock()
+	ended := []Session{}
+	for key, s := range self.Open {
+		if hostname == "" || s.Hostname == hostname {
+			ended = append(ended, self.end(key, at, reason))
+		}
+	}
+	return ended
+}
+
+// Away closes every session of a host that has been idle for longer than the threshold
+func (self *Sessions) Away(hostname string, idle, now int64) []Session {
+	if idle <= self.threshold() {
+		return []Session{}
+	}
+	return self.EndHost(hostname, now-idle, SESSION_IDLE)
+}
+
+// Sweep closes sessions without activity for longer than the threshold
+func (self *Sessions) Sweep(now int64) []Session {
+	self.Lock()
+	defer self.Unlock()
+	ended := []Session{}
+	for key, s := range self.Open {
+		if now-s.Last > self.threshold() {
+			ended = append(ended, self.end(key, s.Last, SESSION_IDLE))
+		}
+	}
+	return ended
+}
+
+func (self *Sessions) List() []Session {
+	self.Lock()
+	defer self.Unlock()
+	open := []Session{}
+	for _, s := range self.Open {
+		open = append(open, *s)
+	}
+	return open
+}
+
+// RecordSessions writes ended sessions to history
+func (self *Server) RecordSessions(ended []Session) {
+	for _, s := range ended {
+		session := s
+		self.record(HistoryEvent{
+			T:        session.End,
+			Kind:     EVENT_SESSION,
+			UUID:     session.UUID,
+			Name:     session.Name,
+			Hostname: session.Hostname,
+			Detail:   session.Reason,
+			Session:  &session,
+		})
+	}
+}
+
+// trackSessions ends sessions on the events that end them, see Record
+func (self *Server) trackSessions(ev HistoryEvent) {
+	switch ev.Kind {
+	case EVENT_CLOSE, EVENT_EXPIRED, EVENT_RELEASED:
+		self.RecordSessions(self.Sessions.End(ev.Hostname, ev.UUID, ev.T, SESSION_CLOSED))
+	case EVENT_LEAVE:
+		self.RecordSessions(self.Sessions.EndHost(ev.Hostname, ev.T, SESSION_LOST))
+	}
+}
+
+// Timesheet is every session overlapping [since, until], and what they add up to
+type Timesheet struct {
+	Since    int64            `json:"since"`
+	Until    int64            `json:"until"`
+	Sessions []Session        `json:"sessions"`
+	Totals   []TimesheetTotal `json:"totals"`
+}
+
+type TimesheetTotal struct {
+	Hostname string  `json:"hostname"`
+	UUID     string  `json:"uuid"`
+	Name     string  `json:"name"`
+	Sessions int     `json:"sessions"`
+	Seconds  int64   `json:"seconds"` // Clipped to the range
+	Hours    float64 `json:"hours"`
+}
+
+func BuildTimesheet(sessions []Session, since, until int64) Timesheet {
+	sheet := Timesheet{Since: since, Until: until, Sessions: []Session{}, Totals: []TimesheetTotal{}}
+	totals := map[string]*TimesheetTotal{}
+	for _, s := range sessions {
+		end := s.End
+		if end == 0 {
+			end = until
+		}
+		start := s.Start
+		if start < since {
+			start = since
+		}
+		if end > until {
+			end = until
+		}
+		if end < start || s.Start > until {
+			continue
+		}
+		sheet.Sessions = append(sheet.Sessions, s)
+		key := s.Hostname + "/" + s.UUID
+		total, hasKey := totals[key]
+		if !hasKey {
+			total = &TimesheetTotal{Hostname: s.Hostname, UUID: s.UUID, Name: s.Name}
+			totals[key] = total
+		}
+		total.Sessions += 1
+		total.Seconds += end - start
+	}
+	for _, total := range totals {
+		total.Hours = hours(total.Seconds)
+		sheet.Totals = append(sheet.Totals, *total)
+	}
+	sort.Slice(sheet.Sessions, func(i, j int) bool {
+		return sheet.Sessions[i].Start < sheet.Sessions[j].Start
+	})
+	sort.Slice(sheet.Totals, func(i, j int) bool {
+		if sheet.Totals[i].Hostname != sheet.Totals[j].Hostname {
+			return sheet.Totals[i].Hostname < sheet.Totals[j].Hostname
+		}
+		return sheet.Totals[i].Name < sheet.Totals[j].Name
+	})
+	return sheet
+}
+
+// QuerySessions returns recorded and open sessions matching the filter, ending after `since`
+func (self *Server) QuerySessions(uuid, hostname string, since int64) []Session {
+	sessions := []Session{}
+	filter := HistoryFilter{UUID: uuid, Hostname: hostname, Kind: EVENT_SESSION, Since: since}
+	for _, ev := range self.History.Query(filter) {
+		if ev.Session != nil {
+			sessions = append(sessions, *ev.Session)
+		}
+	}
+	for _, s := range self.Sessions.List() {
+		if (uuid == "" || s.UUID == uuid) && (hostname == "" || s.Hostname == hostname) {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+func (self *Server) GET_Timesheet(c *gin.Context) {
+	since, until, err := ReportRange(c.Query("since"), c.Query("until"))
+	if err != nil {
+		JSONError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	sessions := self.QuerySessions(c.Query("uuid"), c.Query("hostname"), since)
+	c.JSON(200, BuildTimesheet(sessions, since, until))
+}
+
+func (self *Server) GET_Sessions(c *gin.Context) {
+	c.JSON(200, self.Sessions.List())
+}
+
+// SweepSessions closes idle sessions, see Server.Start
+func (self *Server) SweepSessions() {
+	self.RecordSessions(self.Sessions.Sweep(time.Now().Unix()))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ScanStatus is what the last GetOpenFCPLibraries found, see WatcherOpenLibraries
+type ScanStatus struct {
+	T         int64        `json:"t"`
+	Duration  float64      `json:"duration_ms"`
+	Libraries FCPLibraries `json:"libraries"`
+	Errors    []string     `json:"errors"`
+}
+
+type LastScan struct {
+	sync.Mutex
+	Scan ScanStatus
+}
+
+func (self *LastScan) Set(t time.Time, libs FCPLibraries, errs []error) {
+	self.Lock()
+	defer self.Unlock()
+	self.Scan = ScanStatus{
+		T:         t.Unix(),
+		Duration:  Lag(t),
+		Libraries: libs,
+		Errors:    []string{},
+	}
+	for _, err := range errs {
+		self.Scan.Errors = append(self.Scan.Errors, err.Error())
+	}
+}
+
+func (self *LastScan) Get() ScanStatus {
+	self.Lock()
+	defer self.Unlock()
+	return self.Scan
+}
+
+var lastScan = &LastScan{}
+
+type MemberStatus struct {
+	URL       string  `json:"url"`
+	RTT       float64 `json:"rtt_ms,omitempty"` // From the last CheckMembersAlive
+	AWOL      bool    `json:"awol"`
+	AWOLSince int64   `json:"awol_since,omitempty"`
+}
+
+// ServerResponse is the last CheckoutResponse from a server
+type ServerResponse struct {
+	T        int64            `json:"t"`
+	Response CheckoutResponse `json:"response"`
+}
+
+func NewClientState() *ClientState {
+	return &ClientState{
+		Members:   map[string]MemberStatus{},
+		Responses: map[string]ServerResponse{},
+	}
+}
+
+// ClientState is a copy of what GET /status shows about the servers, so the
+// router never waits on a broadcast in progress
+type ClientState struct {
+	sync.Mutex
+	Members   map[string]MemberStatus
+	Responses map[string]ServerResponse
+}
+
+// SetMembers is called by the client services loop, see Client.Start
+func (self *ClientState) SetMembers(host *Host) {
+	members := map[string]MemberStatus{}
+	for hostname, url := range host.Service.MemberList() {
+		rtt, since, isAWOL := host.Health(hostname)
+		m := MemberStatus{URL: url, RTT: rtt}
+		if isAWOL {
+			m.AWOL = true
+			m.AWOLSince = since.Unix()
+		}
+		members[hostname] = m
+	}
+	self.Lock()
+	defer self.Unlock()
+	self.Members = members
+}
+
+func (self *ClientState) SetResponse(server string, res CheckoutResponse) {
+	self.Lock()
+	defer self.Unlock()
+	self.Responses[server] = ServerResponse{T: time.Now().Unix(), Response: res}
+}
+
+type ClientStatus struct {
+	Hostname  string                    `json:"hostname"`
+	Version   string                    `json:"version"`
+	Scan      ScanStatus                `json:"scan"`
+	Watched   []string                  `json:"watched"`
+	Members   map[string]MemberStatus   `json:"members"`
+	Responses map[string]ServerResponse `json:"responses"`
+}
+
+func (self *Client) Status() ClientStatus {
+	self.State.Lock()
+	defer self.State.Unlock()
+	status := ClientStatus{
+		Hostname:  self.Hostname,
+		Version:   self.Service.TXTRecord["version"],
+		Scan:      lastScan.Get(),
+		Watched:   self.WatchPaths,
+		Members:   map[string]MemberStatus{},
+		Responses: map[string]ServerResponse{},
+	}
+	for hostname, m := range self.State.Members {
+		status.Members[hostname] = m
+	}
+	for server, res := range self.State.Responses {
+		status.Responses[server] = res
+	}
+	return status
+}
+
+// GET_Status is for when an editor says "the monitor doesn't see my library"
+func (self *Client) GET_Status(c *gin.Context) {
+	c.JSON(200, self.Status())
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	STORAGE_MIN_RESCAN = 1 * time.Minute  // Folders that changed are rescanned at most this often
+	STORAGE_MAX_AGE    = 30 * time.Minute // Everything is rescanned after this
+)
+
+var (
+	storageCache = NewStorageCache()
+)
+
+type BundleStorage struct {
+	Databases      int64 `json:"databases"`
+	RenderFiles    int64 `json:"render_files"`
+	ProxyMedia     int64 `json:"proxy_media"`
+	OptimizedMedia int64 `json:"optimized_media"`
+	AnalysisFiles  int64 `json:"analysis_files"`
+	OriginalMedia  int64 `json:"original_media"`
+	Other          int64 `json:"other"`
+	Total          int64 `json:"total"`
+	Scanned        int64 `json:"scanned"`
+}
+
+func (self *BundleStorage) Add(other BundleStorage) {
+	self.Databases += other.Databases
+	self.RenderFiles += other.RenderFiles
+	self.ProxyMedia += other.ProxyMedia
+	self.OptimizedMedia += other.OptimizedMedia
+	self.AnalysisFiles += other.AnalysisFiles
+	self.OriginalMedia += other.OriginalMedia
+	self.Other += other.Other
+	self.Total += other.Total
+}
+
+func (self *BundleStorage) AddFile(fp string, size int64) {
+	self.Total += size
+	_, _, kind := BundleChange(fp)
+	switch kind {
+	case CHANGE_LIBRARY_DB, CHANGE_EVENT_DB:
+		self.Databases += size
+	case CHANGE_RENDER:
+		self.RenderFiles += size
+	case CHANGE_TRANSCODE:
+		if strings.Contains(fp, "/Proxy Media/") {
+			self.ProxyMedia += size
+		} else {
+			self.OptimizedMedia += size
+		}
+	case CHANGE_ANALYSIS:
+		self.AnalysisFiles += size
+	case CHANGE_MEDIA:
+		self.OriginalMedia += size
+	default:
+		self.Other += size
+	}
+}
+
+// ScanStorage adds up every file under `fp`. Symlinks e.g. external media are not followed.
+func ScanStorage(root string) BundleStorage {
+	storage := BundleStorage{}
+	// Walk doesn't descend into a root that is itself a symlink
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return storage
+	}
+	filepath.Walk(realRoot, func(fp string, fifo os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !fifo.IsDir() {
+			rel, _ := filepath.Rel(realRoot, fp)
+			storage.AddFile(filepath.Join(root, rel), fifo.Size())
+		}
+		return nil
+	})
+	return storage
+}
+
+type storageEntry struct {
+	Folders  map[string]BundleStorage // Top level folder in the bundle -> usage, "" for files at the root
+	Dirty    map[string]bool
+	Scanned  time.Time
+	Full     time.Time
+	Scanning bool
+	Storage  *BundleStorage
+}
+
+func NewStorageCache() *StorageCache {
+	return &StorageCache{Entries: map[string]*storageEntry{}}
+}
+
+// StorageCache scans bundles in the background and only rescans the folders
+// that the filesystem watcher says have changed.
+type StorageCache struct {
+	sync.Mutex
+	Entries map[string]*storageEntry
+	Scans   chan string // If set, receives the path of every finished scan
+}
+
+// Get returns the last known usage of a bundle, nil if it was never scanned, and
+// starts a rescan if one is due.
+func (self *StorageCache) Get(bundlePath string) *BundleStorage {
+	self.Lock()
+	defer self.Unlock()
+	entry, hasKey := self.Entries[bundlePath]
+	if !hasKey {
+		entry = &storageEntry{
+			Folders: map[string]BundleStorage{},
+			Dirty:   map[string]bool{},
+		}
+		self.Entries[bundlePath] = entry
+	}
+	if !entry.Scanning {
+		full := time.Since(entry.Full) > STORAGE_MAX_AGE
+		if full || (len(entry.Dirty) > 0 && time.Since(entry.Scanned) > STORAGE_MIN_RESCAN) {
+			entry.Scanning = true
+			dirty := entry.Dirty
+			entry.Dirty = map[string]bool{}
+			go self.scan(bundlePath, entry, dirty, full)
+		}
+	}
+	return entry.Storage
+}
+
+// Invalidate marks a top level folder of a bundle as changed
+func (self *StorageCache) Invalidate(bundlePath, folder string) {
+	self.Lock()
+	defer self.Unlock()
+	entry, hasKey := self.Entries[bundlePath]
+	if hasKey {
+		entry.Dirty[folder] = true
+	}
+}
+
+func (self *StorageCache) scan(bundlePath string, entry *storageEntry, dirty map[string]bool, full bool) {
+
+	folders := map[string]BundleStorage{}
+	root := BundleStorage{}
+	files, _ := ioutil.ReadDir(bundlePath)
+	for _, fifo := range files {
+		if !fifo.IsDir() {
+			root.AddFile(filepath.Join(bundlePath, fifo.Name()), fifo.Size())
+			continue
+		}
+		self.Lock()
+		cached, hasKey := entry.Folders[fifo.Name()]
+		self.Unlock()
+		if hasKey && !full && !dirty[fifo.Name()] {
+			folders[fifo.Name()] = cached
+		} else {
+			folders[fifo.Name()] = ScanStorage(filepath.Join(bundlePath, fifo.Name()))
+		}
+	}
+	folders[""] = root
+
+	storage := BundleStorage{}
+	for _, usage := range folders {
+		storage.Add(usage)
+	}
+	storage.Scanned = time.Now().Unix()
+
+	self.Lock()
+	entry.Folders = folders
+	entry.Storage = &storage
+	entry.Scanned = time.Now()
+	if full {
+		entry.Full = entry.Scanned
+	}
+	entry.Scanning = false
+	self.Unlock()
+
+	if self.Scans != nil {
+		self.Scans <- bundlePath
+	}
+
+}
+
+// Forget drops bundles that are no longer open
+func (self *StorageCache) Forget(open map[string]bool) {
+	self.Lock()
+	defer self.Unlock()
+	for bundlePath, _ := range self.Entries {
+		if !open[bundlePath] {
+			delete(self.Entries, bundlePath)
+		}
+	}
+}
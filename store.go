@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	LIBRARY_STORE = "library.json"
+)
+
+// Save writes the library to `fp`. The caller must hold the lock.
+func (self *Library) Save(fp string) error {
+	b, err := json.MarshalIndent(self, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temp file first so a crash mid-write never leaves a truncated store
+	tmp := fp + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
+
+// Load restores the library from `fp`. Every checkout is marked unconfirmed
+// until its host reports in again, and gets a fresh lease so hosts have a chance
+// to do so. A missing file is not an error.
+func (self *Library) Load(fp string) error {
+	b, err := ioutil.ReadFile(fp)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lib := struct {
+		Projects      map[string]*Project       `json:"library"`
+		Reservations  map[string]*Reservation   `json:"reservations"`
+		Timelines     map[string][]VersionEvent `json:"timelines"`
+		Subscriptions map[string][]string       `json:"subscriptions"`
+		Stamps        map[string]Stamp          `json:"stamps"`
+	}{}
+	err = json.Unmarshal(b, &lib)
+	if err != nil {
+		return err
+	}
+	for _, project := range lib.Projects {
+		if project.Checkouts == nil {
+			project.Checkouts = map[string]*Checkout{}
+		}
+		for _, chk := range project.Checkouts {
+			chk.Unconfirmed = true
+			chk.Expires = self.Lease()
+		}
+	}
+	if lib.Projects != nil {
+		self.Projects = lib.Projects
+	}
+	if lib.Reservations != nil {
+		self.Reservations = lib.Reservations
+	}
+	if lib.Timelines != nil {
+		self.Timelines = lib.Timelines
+	}
+	if lib.Subscriptions != nil {
+		self.Subscriptions = lib.Subscriptions
+	}
+	if lib.Stamps != nil {
+		self.Stamps = lib.Stamps
+	}
+	return nil
+}
+
+func (self *Server) LoadLibrary() {
+	if self.StorePath == "" {
+		return
+	}
+	self.Library.Lock()
+	defer self.Library.Unlock()
+	err := self.Library.Load(self.StorePath)
+	if err != nil {
+		LogError("[STORE] " + err.Error())
+		return
+	}
+	log.Printf("📦 [STORE] %d projects restored from %s", len(self.Library.Projects), filepath.Base(self.StorePath))
+}
+
+// SaveLibrary persists the library and schedules replication to peers. The caller must hold the lock.
+func (self *Server) SaveLibrary() {
+	self.MarkDirty()
+	self.writeLibrary()
+}
+
+// DeferSave is SaveLibrary for updates, which come too often to rewrite the
+// file for each. It's written by FlushLibrary. The caller must hold the lock.
+func (self *Server) DeferSave() {
+	self.MarkDirty()
+	self.Unsaved = true
+}
+
+// FlushLibrary writes deferred saves, every minute and at shutdown
+func (self *Server) FlushLibrary() {
+	self.Library.Lock()
+	defer self.Library.Unlock()
+	if self.Unsaved {
+		self.writeLibrary()
+	}
+}
+
+func (self *Server) writeLibrary() {
+	self.Unsaved = false
+	if self.StorePath == "" {
+		return
+	}
+	err := self.Library.Save(self.StorePath)
+	if err != nil {
+		LogError("[STORE] " + err.Error())
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EVENT_AFK   = "afk"
+	EVENT_JOIN  = "join"
+	EVENT_LEAVE = "leave"
+)
+
+func NewBroker() *Broker {
+	return &Broker{Subscribers: map[chan HistoryEvent]bool{}}
+}
+
+// Broker fans events out to every open /events stream
+type Broker struct {
+	sync.Mutex
+	Subscribers map[chan HistoryEvent]bool
+}
+
+func (self *Broker) Subscribe() chan HistoryEvent {
+	self.Lock()
+	defer self.Unlock()
+	ch := make(chan HistoryEvent, 100)
+	self.Subscribers[ch] = true
+	return ch
+}
+
+func (self *Broker) Unsubscribe(ch chan HistoryEvent) {
+	self.Lock()
+	defer self.Unlock()
+	delete(self.Subscribers, ch)
+}
+
+// Publish never blocks, a subscriber that can't keep up misses events
+func (self *Broker) Publish(ev HistoryEvent) {
+	self.Lock()
+	defer self.Unlock()
+	for ch, _ := range self.Subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Publish sends an event to the live stream without writing it to history
+func (self *Server) Publish(kind, uuid, name, hostname, detail string) {
+	self.Broker.Publish(HistoryEvent{
+		T:        time.Now().Unix(),
+		Kind:     kind,
+		UUID:     uuid,
+		Name:     name,
+		Hostname: hostname,
+		Detail:   detail,
+	})
+}
+
+// DiffMembers records hosts that joined or left since the last call
+func (self *Server) DiffMembers() {
+	members := self.Service.MemberList()
+	current := map[string]bool{}
+	for hostname, _ := range members {
+		current[hostname] = true
+	}
+	joined, left := []string{}, []string{}
+	for hostname, _ := range current {
+		if !self.KnownMembers[hostname] {
+			joined = append(joined, hostname)
+		}
+	}
+	for hostname, _ := range self.KnownMembers {
+		if !current[hostname] {
+			left = append(left, hostname)
+		}
+	}
+	sort.Strings(joined)
+	sort.Strings(left)
+	for _, hostname := range joined {
+		self.Record(EVENT_JOIN, "", "", hostname, members[hostname])
+	}
+	for _, hostname := range left {
+		log.Printf("👋 [%s] left", hostname)
+		self.Record(EVENT_LEAVE, "", "", hostname, "")
+		if change, changed := self.AFK.Offline(hostname, time.Now().Unix()); changed {
+			self.RecordPresence(change)
+		}
+	}
+	self.KnownMembers = current
+}
+
+func (self *Server) GET_Events(c *gin.Context) {
+
+	filter := HistoryFilter{
+		UUID:     c.Query("uuid"),
+		Hostname: c.Query("hostname"),
+		Kind:     c.Query("kind"),
+	}
+
+	ch := self.Broker.Subscribe()
+	defer self.Broker.Unsubscribe(ch)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-keepalive.C:
+			c.SSEvent("ping", strconv.FormatInt(time.Now().Unix(), 10))
+			return true
+		case ev := <-ch:
+			if filter.Match(ev) {
+				c.SSEvent(ev.Kind, ev)
+			}
+			return true
+		}
+	})
+
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"time"
+)
+
+const (
+	CERT_FILE   = "cert.pem"
+	KEY_FILE    = "key.pem"
+	KNOWN_HOSTS = "known_hosts"
+)
+
+// Set in main, nodes serve plain http only when this is nil
+var nodeCertificate *tls.Certificate
+
+// Fingerprints of peers, pinned the first time we see them
+var knownHosts = NewKnownHosts("")
+
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadOrCreateCertificate reuses the certificate in dir so the fingerprint survives restarts
+func LoadOrCreateCertificate(dir, hostname string) (tls.Certificate, string, error) {
+
+	certPath := filepath.Join(dir, CERT_FILE)
+	keyPath := filepath.Join(dir, KEY_FILE)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		return cert, Fingerprint(cert.Certificate[0]), nil
+	}
+	if _, statErr := os.Stat(certPath); statErr == nil {
+		// Don't silently replace a certificate peers have pinned
+		return cert, "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return cert, "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return cert, "", err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"FCPXMonitor"}},
+		DNSNames:              []string{hostname, hostname + ".local"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(20, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return cert, "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return cert, "", err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	err = ioutil.WriteFile(keyPath, keyPEM, 0600)
+	if err != nil {
+		return cert, "", err
+	}
+	err = ioutil.WriteFile(certPath, certPEM, 0644)
+	if err != nil {
+		return cert, "", err
+	}
+
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return cert, "", err
+	}
+	return cert, Fingerprint(der), nil
+
+}
+
+// NewPinnedClient only talks to a peer presenting the certificate with fingerprint fp
+func NewPinnedClient(fp string) *http.Client {
+	c := NewHTTPTimeoutClient()
+	if fp == "" {
+		return c
+	}
+	c.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			// Self-signed, the pin below replaces chain verification
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 || Fingerprint(rawCerts[0]) != fp {
+					return errors.New("Certificate doesn't match pinned fingerprint")
+				}
+				return nil
+			},
+		},
+	}
+	return c
+}
+
+func NewKnownHosts(fp string) *KnownHosts {
+	return &KnownHosts{Path: fp, Pins: map[string]string{}}
+}
+
+// KnownHosts is trust on first use, one "hostname fingerprint" per line
+type KnownHosts struct {
+	sync.Mutex
+	Path string
+	Pins map[string]string
+}
+
+func (self *KnownHosts) Load(fp string) error {
+	self.Lock()
+	defer self.Unlock()
+	self.Path = fp
+	f, err := os.Open(fp)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			self.Pins[fields[0]] = fields[1]
+		}
+	}
+	return scanner.Err()
+}
+
+func (self *KnownHosts) Get(hostname string) string {
+	self.Lock()
+	defer self.Unlock()
+	return self.Pins[hostname]
+}
+
+// Check fails if hostname was pinned to another fingerprint
+func (self *KnownHosts) Check(hostname, fp string) error {
+	pinned := self.Get(hostname)
+	if pinned != "" && pinned != fp {
+		return errors.New(fmt.Sprintf("Fingerprint of '%s' changed from %s to %s, remove it from %s if this is expected", hostname, shortFingerprint(pinned), shortFingerprint(fp), KNOWN_HOSTS))
+	}
+	return nil
+}
+
+// CheckPeer is Check, also refusing peers that could be downgraded to plain http:
+// a pinned host that stops advertising its certificate, or any peer without one
+// when we require TLS ourselves
+func (self *KnownHosts) CheckPeer(hostname, fp string, requireTLS bool) error {
+	if fp != "" {
+		return self.Check(hostname, fp)
+	}
+	if self.Get(hostname) != "" {
+		return errors.New(fmt.Sprintf("'%s' is pinned in %s but advertises no certificate", hostname, KNOWN_HOSTS))
+	}
+	if requireTLS {
+		return errors.New(fmt.Sprintf("'%s' advertises no certificate, TLS is required", hostname))
+	}
+	return nil
+}
+
+func shortFingerprint(fp string) string {
+	if len(fp) > 16 {
+		return fp[:16]
+	}
+	return fp
+}
+
+func (self *KnownHosts) Pin(hostname, fp string) error {
+	self.Lock()
+	defer self.Unlock()
+	if self.Pins[hostname] == fp {
+		return nil
+	}
+	self.Pins[hostname] = fp
+	if self.Path == "" {
+		return nil
+	}
+	lines := []string{}
+	for h, p := range self.Pins {
+		lines = append(lines, h+" "+p)
+	}
+	sort.Strings(lines)
+	return ioutil.WriteFile(self.Path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// NewNodeClient returns the client to reach a member, pinned if it advertised a fingerprint
+func NewNodeClient(hostname string) *http.Client {
+	return NewPinnedClient(knownHosts.Get(hostname))
+}
+
+// Run serves https, and plain http for what RequireTLS lets through, on the same port
+func (self *Host) Run() error {
+	addr := fmt.Sprintf(":%d", self.Port)
+	if nodeCertificate == nil {
+		return self.Router.Run(addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return NewNodeServer(self.Router).Serve(NewSniffListener(l, &tls.Config{Certificates: []tls.Certificate{*nodeCertificate}}))
+}
+
+type connKey struct{}
+
+// NewNodeServer keeps each request's connection so IsTLS can tell how it came in
+func NewNodeServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler: handler,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
+	}
+}
+
+// IsTLS is true for requests over https, including through a sniffListener
+func IsTLS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	sc, ok := r.Context().Value(connKey{}).(*sniffConn)
+	if !ok {
+		return false
+	}
+	_, isTLS := sc.conn.(*tls.Conn)
+	return isTLS
+}
+
+// RequireTLS refuses plain http once the node has a certificate, but for /_ping
+// and requests from this machine e.g. the updater's /_shutdown
+func RequireTLS(c *gin.Context) {
+	if nodeCertificate == nil || IsTLS(c.Request) || c.Request.URL.Path == "/_ping" {
+		return
+	}
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return
+		}
+	}
+	JSONError(c, http.StatusForbidden, "TLS is required, use https")
+}
+
+func NewSniffListener(l net.Listener, config *tls.Config) net.Listener {
+	return &sniffListener{Listener: l, config: config}
+}
+
+type sniffListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (self *sniffListener) Accept() (net.Conn, error) {
+	conn, err := self.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sniffConn{Conn: conn, config: self.config}, nil
+}
+
+// sniffConn decides between tls and plain on the first byte, a TLS handshake starts with 0x16
+type sniffConn struct {
+	net.Conn
+	config *tls.Config
+	once   sync.Once
+	conn   net.Conn
+	err    error
+}
+
+func (self *sniffConn) sniff() {
+	b := make([]byte, 1)
+	n, err := self.Conn.Read(b)
+	if n == 0 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		self.err = err
+		return
+	}
+	plain := &prefixConn{Conn: self.Conn, prefix: b[:n]}
+	if b[0] == 0x16 {
+		self.conn = tls.Server(plain, self.config)
+	} else {
+		self.conn = plain
+	}
+}
+
+func (self *sniffConn) Read(p []byte) (int, error) {
+	self.once.Do(self.sniff)
+	if self.conn == nil {
+		return 0, self.err
+	}
+	return self.conn.Read(p)
+}
+
+func (self *sniffConn) Write(p []byte) (int, error) {
+	self.once.Do(self.sniff)
+	if self.conn == nil {
+		return 0, self.err
+	}
+	return self.conn.Write(p)
+}
+
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (self *prefixConn) Read(p []byte) (int, error) {
+	if len(self.prefix) > 0 {
+		n := copy(p, self.prefix)
+		self.prefix = self.prefix[n:]
+		return n, nil
+	}
+	return self.Conn.Read(p)
+}
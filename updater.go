@@ -19,7 +19,11 @@ func NewUpdater(runDir string, port int) (selfupdate.SelfUpdate, error) {
 		version := <-updater.ChangeChan
 		url := fmt.Sprintf("http://localhost:%d/_shutdown", port)
 		log.Println("🤞 [UPDATE] version: " + version[0:7])
-		res, err := http.Get(url)
+		req, err := NewSignedRequest("GET", url, NOBODY)
+		var res *http.Response
+		if err == nil {
+			res, err = http.DefaultClient.Do(req)
+		}
 		if err != nil || res.StatusCode != http.StatusOK {
 			LogError("[UPDATE] Failed")
 		}
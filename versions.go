@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	versionRules = DefaultVersionRules().MustCompile()
+	re_digits    = regexp.MustCompile(`\d+`)
+)
+
+// VersionRules decide which folders next to a library hold deliverables and how
+// to read a version out of a file name. A version pattern orders files by its
+// `number` and `date` groups, then by its `revision` group e.g. v3 < v3a < v3b < v4.
+type VersionRules struct {
+	Folders  []string `json:"folders"`
+	Patterns []string `json:"patterns"`
+}
+
+func DefaultVersionRules() VersionRules {
+	return VersionRules{
+		Folders: []string{
+			`(?i)^outputs?$`,
+			`(?i)^exports?$`,
+			`(?i)^deliverables?$`,
+		},
+		Patterns: []string{
+			re_versions.String(),
+			`(?i)[ _-]r(?P<number>\d+)(?P<revision>[a-z]?)[. _-].*(mov|mp4|m4v)`,
+			`(?i)(?P<date>\d{4}-\d{2}-\d{2}).*\.(mov|mp4|m4v)$`,
+		},
+	}
+}
+
+func LoadVersionRules(fp string) (CompiledVersionRules, error) {
+	rules := DefaultVersionRules()
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return CompiledVersionRules{}, err
+	}
+	err = json.Unmarshal(b, &rules)
+	if err != nil {
+		return CompiledVersionRules{}, err
+	}
+	return rules.Compile()
+}
+
+type CompiledVersionRules struct {
+	Folders  []*regexp.Regexp
+	Patterns []*regexp.Regexp
+}
+
+func (self VersionRules) Compile() (CompiledVersionRules, error) {
+	compiled := CompiledVersionRules{}
+	for _, s := range self.Folders {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return compiled, errors.New("Bad folder pattern: " + err.Error())
+		}
+		compiled.Folders = append(compiled.Folders, re)
+	}
+	for _, s := range self.Patterns {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return compiled, errors.New("Bad version pattern: " + err.Error())
+		}
+		compiled.Patterns = append(compiled.Patterns, re)
+	}
+	return compiled, nil
+}
+
+func (self VersionRules) MustCompile() CompiledVersionRules {
+	compiled, err := self.Compile()
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+func (self CompiledVersionRules) IsOutputFolder(name string) bool {
+	for _, re := range self.Folders {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+type Deliverable struct {
+	Name    string `json:"name"`
+	Folder  string `json:"folder"`
+	Version string `json:"version"`
+	Size    int64  `json:"size"`
+	Mtime   int64  `json:"mtime"`
+	Order   []int  `json:"order,omitempty"` // Numbers read from the name, see Less
+	Rev     string `json:"rev,omitempty"`
+	Rule    int    `json:"rule"` // Index of the pattern that read the version
+}
+
+// Parse reads the version out of a file name with the first pattern that matches
+func (self CompiledVersionRules) Parse(filename string) (Deliverable, bool) {
+	d := Deliverable{Name: filename}
+	for rule, re := range self.Patterns {
+		m := re.FindStringSubmatchIndex(filename)
+		if m == nil {
+			continue
+		}
+		d.Rule = rule
+		// The version label runs from the start of the match to the end of the last group we read
+		labelStart, labelEnd := m[0], m[0]
+		for i, group := range re.SubexpNames() {
+			if m[2*i] < 0 {
+				continue
+			}
+			value := filename[m[2*i]:m[2*i+1]]
+			switch group {
+			case "number", "date":
+				for _, digits := range re_digits.FindAllString(value, -1) {
+					n, _ := strconv.Atoi(digits)
+					d.Order = append(d.Order, n)
+				}
+			case "revision":
+				d.Rev = strings.ToLower(value)
+			default:
+				continue
+			}
+			if group == "date" {
+				labelStart = m[2*i]
+			}
+			if m[2*i+1] > labelEnd {
+				labelEnd = m[2*i+1]
+			}
+		}
+		d.Version = strings.Trim(filename[labelStart:labelEnd], " _-.")
+		return d, true
+	}
+	return d, false
+}
+
+// Less orders versions by number, then revision letter, then modification time.
+// Only versions read by the same pattern compare, see SortDeliverables.
+func (self Deliverable) Less(other Deliverable) bool {
+	for i := 0; i < len(self.Order) && i < len(other.Order); i++ {
+		if self.Order[i] != other.Order[i] {
+			return self.Order[i] < other.Order[i]
+		}
+	}
+	if len(self.Order) != len(other.Order) {
+		return len(self.Order) < len(other.Order)
+	}
+	if self.Rev != other.Rev {
+		return self.Rev < other.Rev
+	}
+	if self.Mtime != other.Mtime {
+		return self.Mtime < other.Mtime
+	}
+	return self.Name < other.Name
+}
+
+// SortDeliverables orders versions oldest first. A folder mixing naming schemes
+// e.g. "v3" and "2019-09-01" is sorted per pattern, and the pattern with the
+// most recently modified file comes last.
+func SortDeliverables(versions []Deliverable) {
+	newest := map[int]int64{}
+	for _, d := range versions {
+		if d.Mtime > newest[d.Rule] {
+			newest[d.Rule] = d.Mtime
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		if a.Rule != b.Rule {
+			if newest[a.Rule] != newest[b.Rule] {
+				return newest[a.Rule] < newest[b.Rule]
+			}
+			return a.Rule < b.Rule
+		}
+		return a.Less(b)
+	})
+}
+
+// FindVersions lists every deliverable in the output folders next to a library, oldest version first
+func FindVersions(bundlePath string) []Deliverable {
+	versions := []Deliverable{}
+	parent, _ := filepath.Split(bundlePath)
+	folders, _ := ioutil.ReadDir(parent)
+	for _, folder := range folders {
+		if !folder.IsDir() || !versionRules.IsOutputFolder(folder.Name()) {
+			continue
+		}
+		files, _ := ioutil.ReadDir(filepath.Join(parent, folder.Name()))
+		for _, fifo := range files {
+			if fifo.IsDir() {
+				continue
+			}
+			d, ok := versionRules.Parse(fifo.Name())
+			if !ok {
+				continue
+			}
+			d.Folder = folder.Name()
+			d.Size = fifo.Size()
+			d.Mtime = fifo.ModTime().Unix()
+			versions = append(versions, d)
+		}
+	}
+	SortDeliverables(versions)
+	return versions
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	WEBHOOK_LOG_SIZE        = 200
+	WEBHOOK_DEFAULT_RETRIES = 3
+	WEBHOOK_DEFAULT_BACKOFF = 2 * time.Second
+)
+
+/*
+	webhooks.json
+	[
+		{
+			"name": "chat",
+			"url": "https://chat.example.com/hooks/abc",
+			"events": ["checkout", "conflict", "close", "version"],
+			"template": "{\"text\": {{json (printf \"%s %s %s\" .Hostname .Kind .Name)}}}",
+			"retries": 3,
+			"backoff": "2s"
+		}
+	]
+
+	Without a template the HistoryEvent itself is posted as JSON.
+*/
+
+type Webhook struct {
+	Name     string            `json:"name"`
+	URL      string            `json:"url"`
+	Events   []string          `json:"events"`   // Kinds of HistoryEvent to send, all if empty
+	Template string            `json:"template"` // text/template executed with the HistoryEvent
+	Headers  map[string]string `json:"headers"`
+	Retries  *int              `json:"retries"` // WEBHOOK_DEFAULT_RETRIES if missing, 0 for none
+	Backoff  string            `json:"backoff"` // Doubles after every failed attempt
+	tmpl     *template.Template
+	retries  int
+	backoff  time.Duration
+}
+
+type WebhookDelivery struct {
+	Webhook  string `json:"webhook"`
+	Kind     string `json:"kind"`
+	UUID     string `json:"uuid"`
+	Hostname string `json:"hostname"`
+	Status   int    `json:"status"` // Of the last attempt, 0 if unreachable
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+	T        int64  `json:"t"`
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"iso": func(t int64) string {
+		return time.Unix(t, 0).Format(time.RFC3339)
+	},
+}
+
+func (self *Webhook) Compile() error {
+	if self.URL == "" {
+		return errors.New("Webhook without a url: " + self.Name)
+	}
+	if self.Template != "" {
+		tmpl, err := template.New(self.Name).Funcs(webhookFuncs).Parse(self.Template)
+		if err != nil {
+			return err
+		}
+		self.tmpl = tmpl
+	}
+	self.retries = WEBHOOK_DEFAULT_RETRIES
+	if self.Retries != nil {
+		if *self.Retries < 0 {
+			return errors.New("Webhook with negative retries: " + self.Name)
+		}
+		self.retries = *self.Retries
+	}
+	self.backoff = WEBHOOK_DEFAULT_BACKOFF
+	if self.Backoff != "" {
+		d, err := time.ParseDuration(self.Backoff)
+		if err != nil {
+			return err
+		}
+		self.backoff = d
+	}
+	return nil
+}
+
+func (self *Webhook) Match(ev HistoryEvent) bool {
+	if len(self.Events) == 0 {
+		return true
+	}
+	for _, kind := range self.Events {
+		if kind == ev.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Webhook) Payload(ev HistoryEvent) ([]byte, error) {
+	if self.tmpl == nil {
+		return json.Marshal(ev)
+	}
+	b := &bytes.Buffer{}
+	err := self.tmpl.Execute(b, ev)
+	return b.Bytes(), err
+}
+
+func LoadWebhooks(fp string) ([]*Webhook, error) {
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	hooks := []*Webhook{}
+	err = json.Unmarshal(b, &hooks)
+	if err != nil {
+		return nil, err
+	}
+	for i, hook := range hooks {
+		if hook.Name == "" {
+			hook.Name = fmt.Sprintf("webhook-%d", i+1)
+		}
+		err = hook.Compile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hooks, nil
+}
+
+func NewWebhooks(hooks []*Webhook) *Webhooks {
+	return &Webhooks{Hooks: hooks, Log: []WebhookDelivery{}}
+}
+
+type Webhooks struct {
+	sync.Mutex
+	Hooks []*Webhook
+	Log   []WebhookDelivery // Most recent last
+}
+
+// Fire delivers `ev` to every matching webhook in the background
+func (self *Webhooks) Fire(ev HistoryEvent) {
+	if self == nil {
+		return
+	}
+	for _, hook := range self.Hooks {
+		if hook.Match(ev) {
+			go self.Deliver(hook, ev)
+		}
+	}
+}
+
+func (self *Webhooks) Deliver(hook *Webhook, ev HistoryEvent) WebhookDelivery {
+
+	delivery := WebhookDelivery{
+		Webhook:  hook.Name,
+		Kind:     ev.Kind,
+		UUID:     ev.UUID,
+		Hostname: ev.Hostname,
+		T:        time.Now().Unix(),
+	}
+
+	body, err := hook.Payload(ev)
+	if err != nil {
+		delivery.Error = err.Error()
+		self.log(delivery)
+		return delivery
+	}
+
+	c := NewHTTPTimeoutClient()
+	wait := hook.backoff
+	for delivery.Attempts < hook.retries+1 {
+		if delivery.Attempts > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		delivery.Attempts += 1
+		req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+		if err != nil {
+			delivery.Error = err.Error()
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range hook.Headers {
+			req.Header.Set(k, v)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			delivery.Status = 0
+			delivery.Error = err.Error()
+			continue
+		}
+		res.Body.Close()
+		delivery.Status = res.StatusCode
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			delivery.Error = ""
+			break
+		}
+		delivery.Error = fmt.Sprintf("HTTP %d", res.StatusCode)
+		if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			// The receiver won't like it any better next time
+			break
+		}
+	}
+
+	if delivery.Error != "" {
+		LogWarning(fmt.Sprintf("[WEBHOOK] [%s] %s %s: %s", hook.Name, ev.Kind, ev.UUID, delivery.Error))
+	}
+	self.log(delivery)
+	return delivery
+
+}
+
+func (self *Webhooks) log(delivery WebhookDelivery) {
+	self.Lock()
+	defer self.Unlock()
+	self.Log = append(self.Log, delivery)
+	if len(self.Log) > WEBHOOK_LOG_SIZE {
+		self.Log = self.Log[len(self.Log)-WEBHOOK_LOG_SIZE:]
+	}
+}
+
+// GET_Webhooks leaves out urls and headers, they often carry tokens
+func (self *Server) GET_Webhooks(c *gin.Context) {
+	hooks := []gin.H{}
+	deliveries := []WebhookDelivery{}
+	if self.Webhooks != nil {
+		self.Webhooks.Lock()
+		defer self.Webhooks.Unlock()
+		for _, hook := range self.Webhooks.Hooks {
+			hooks = append(hooks, gin.H{"name": hook.Name, "events": hook.Events, "retries": hook.retries})
+		}
+		deliveries = self.Webhooks.Log
+	}
+	c.JSON(200, gin.H{"webhooks": hooks, "deliveries": deliveries})
+}